@@ -1,26 +1,57 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Request Structures
-type TextPart struct {
-	Text string `json:"text"`
-}
-
 type InlinePart struct {
 	MIMEType string `json:"mime_type"`
 	Data     string `json:"data"` // base64 encoded
 }
 
+type FileDataPart struct {
+	MIMEType string `json:"mime_type,omitempty"`
+	FileURI  string `json:"file_uri"`
+}
+
+type FunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type FunctionResponse struct {
+	ID       string          `json:"id,omitempty"`
+	Name     string          `json:"name"`
+	Response json.RawMessage `json:"response"`
+}
+
 type Part struct {
-	Text       *string     `json:"text,omitempty"`
-	InlineData *InlinePart `json:"inline_data,omitempty"`
+	Text             *string           `json:"text,omitempty"`
+	InlineData       *InlinePart       `json:"inline_data,omitempty"`
+	FileData         *FileDataPart     `json:"file_data,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+	Thought          bool              `json:"thought,omitempty"`
+	ThoughtSignature string            `json:"thoughtSignature,omitempty"`
 }
 
 type Content struct {
@@ -28,8 +59,9 @@ type Content struct {
 	Parts []Part `json:"parts"`
 }
 
+// SystemInstruction is a Content without a role; parts may be text or inline data.
 type SystemInstruction struct {
-	Parts []TextPart `json:"parts"`
+	Parts []Part `json:"parts"`
 }
 
 // --- New/Updated Structs for Features ---
@@ -47,33 +79,46 @@ type GoogleSearchRetrievalConfig struct {
 }
 
 type Tool struct {
-	URLContext            *map[string]interface{}      `json:"url_context,omitempty"`   // Should be an empty object {}
-	GoogleSearch          *map[string]interface{}      `json:"google_search,omitempty"` // Should be an empty object {}
+	FunctionDeclarations  json.RawMessage              `json:"functionDeclarations,omitempty"` // JSON array of FunctionDeclaration
+	URLContext            *map[string]interface{}      `json:"url_context,omitempty"`          // Should be an empty object {}
+	GoogleSearch          *map[string]interface{}      `json:"google_search,omitempty"`        // Should be an empty object {}
 	GoogleSearchRetrieval *GoogleSearchRetrievalConfig `json:"google_search_retrieval,omitempty"`
 }
 
+type FunctionCallingConfig struct {
+	Mode                 string   `json:"mode,omitempty"` // AUTO, ANY or NONE
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+type ToolConfig struct {
+	FunctionCallingConfig *FunctionCallingConfig `json:"functionCallingConfig,omitempty"`
+}
+
 type ThinkingConfig struct {
 	ThinkingBudget  *int  `json:"thinkingBudget,omitempty"`
 	IncludeThoughts *bool `json:"includeThoughts,omitempty"`
 }
 
 type GenerationConfig struct {
-	StopSequences    []string        `json:"stopSequences,omitempty"`
-	Temperature      *float64        `json:"temperature,omitempty"`
-	MaxOutputTokens  *int            `json:"maxOutputTokens,omitempty"`
-	TopP             *float64        `json:"topP,omitempty"`
-	TopK             *int            `json:"topK,omitempty"`
-	ResponseMimeType *string         `json:"responseMimeType,omitempty"`
-	ResponseSchema   json.RawMessage `json:"responseSchema,omitempty"` // OpenAPI subset
-	ThinkingConfig   *ThinkingConfig `json:"thinkingConfig,omitempty"`
+	StopSequences      []string        `json:"stopSequences,omitempty"`
+	Temperature        *float64        `json:"temperature,omitempty"`
+	MaxOutputTokens    *int            `json:"maxOutputTokens,omitempty"`
+	TopP               *float64        `json:"topP,omitempty"`
+	TopK               *int            `json:"topK,omitempty"`
+	ResponseMimeType   *string         `json:"responseMimeType,omitempty"`
+	ResponseSchema     json.RawMessage `json:"responseSchema,omitempty"`     // OpenAPI subset
+	ResponseJSONSchema json.RawMessage `json:"responseJsonSchema,omitempty"` // JSON Schema; excludes responseSchema
+	ThinkingConfig     *ThinkingConfig `json:"thinkingConfig,omitempty"`
 }
 
 type GenerateContentRequest struct {
 	SystemInstruction *SystemInstruction `json:"system_instruction,omitempty"`
 	Contents          []Content          `json:"contents"`
 	Tools             []Tool             `json:"tools,omitempty"`
+	ToolConfig        *ToolConfig        `json:"toolConfig,omitempty"`
 	SafetySettings    []SafetySetting    `json:"safetySettings,omitempty"`
 	GenerationConfig  *GenerationConfig  `json:"generationConfig,omitempty"`
+	CachedContent     string             `json:"cachedContent,omitempty"`
 }
 
 // Response Structures
@@ -91,81 +136,556 @@ type ModelInfo struct {
 }
 
 type ListModelsResponse struct {
-	Models []ModelInfo `json:"models"`
+	Models        []ModelInfo `json:"models"`
+	NextPageToken string      `json:"nextPageToken,omitempty"`
+}
+
+// listModels fetches every page of the models list.
+func listModels(apiKey string) ([]ModelInfo, error) {
+	var models []ModelInfo
+	pageToken := ""
+	for {
+		endpoint := "/models?pageSize=1000"
+		if pageToken != "" {
+			endpoint += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		var response ListModelsResponse
+		if err := makeAPIRequest(apiKey, "GET", endpoint, nil, &response); err != nil {
+			return nil, err
+		}
+		models = append(models, response.Models...)
+		if response.NextPageToken == "" {
+			return models, nil
+		}
+		pageToken = response.NextPageToken
+	}
+}
+
+type ModalityTokenCount struct {
+	Modality   string `json:"modality"`
+	TokenCount int    `json:"tokenCount"`
+}
+
+type UsageMetadata struct {
+	PromptTokenCount        int                  `json:"promptTokenCount"`
+	CandidatesTokenCount    int                  `json:"candidatesTokenCount"`
+	ThoughtsTokenCount      int                  `json:"thoughtsTokenCount"`
+	CachedContentTokenCount int                  `json:"cachedContentTokenCount"`
+	TotalTokenCount         int                  `json:"totalTokenCount"`
+	PromptTokensDetails     []ModalityTokenCount `json:"promptTokensDetails,omitempty"`
+	CandidatesTokensDetails []ModalityTokenCount `json:"candidatesTokensDetails,omitempty"`
+}
+
+type ResponseBlob struct {
+	MIMEType string `json:"mimeType"`
+	Data     string `json:"data"` // base64 encoded
+}
+
+type ResponsePart struct {
+	Text             string        `json:"text,omitempty"`
+	Thought          bool          `json:"thought,omitempty"`
+	ThoughtSignature string        `json:"thoughtSignature,omitempty"`
+	InlineData       *ResponseBlob `json:"inlineData,omitempty"`
+	FunctionCall     *FunctionCall `json:"functionCall,omitempty"`
+}
+
+type ResponseContent struct {
+	Role  string         `json:"role,omitempty"`
+	Parts []ResponsePart `json:"parts"`
+}
+
+type SafetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability"`
+	Blocked     bool   `json:"blocked,omitempty"`
+}
+
+type Candidate struct {
+	Content       ResponseContent `json:"content"`
+	FinishReason  string          `json:"finishReason,omitempty"`
+	Index         int             `json:"index"`
+	SafetyRatings []SafetyRating  `json:"safetyRatings,omitempty"`
+}
+
+type GenerateContentResponse struct {
+	Candidates    []Candidate    `json:"candidates"`
+	UsageMetadata *UsageMetadata `json:"usageMetadata,omitempty"`
+}
+
+// FunctionCalls returns the function calls requested by the first candidate.
+func (r *GenerateContentResponse) FunctionCalls() []FunctionCall {
+	if len(r.Candidates) == 0 {
+		return nil
+	}
+	var calls []FunctionCall
+	for _, p := range r.Candidates[0].Content.Parts {
+		if p.FunctionCall != nil {
+			calls = append(calls, *p.FunctionCall)
+		}
+	}
+	return calls
+}
+
+// modelTurn converts the first candidate back into request form so it can be
+// sent as history, keeping thought signatures the API requires.
+func (r *GenerateContentResponse) modelTurn() Content {
+	turn := Content{Role: "model"}
+	if len(r.Candidates) == 0 {
+		return turn
+	}
+	for _, p := range r.Candidates[0].Content.Parts {
+		part := Part{Thought: p.Thought, ThoughtSignature: p.ThoughtSignature, FunctionCall: p.FunctionCall}
+		if p.Text != "" {
+			text := p.Text
+			part.Text = &text
+		}
+		if p.InlineData != nil {
+			part.InlineData = &InlinePart{MIMEType: p.InlineData.MIMEType, Data: p.InlineData.Data}
+		}
+		turn.Parts = append(turn.Parts, part)
+	}
+	return turn
+}
+
+// Text returns the concatenated non-thought text of the first candidate.
+func (r *GenerateContentResponse) Text() string {
+	if len(r.Candidates) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for _, p := range r.Candidates[0].Content.Parts {
+		if !p.Thought {
+			sb.WriteString(p.Text)
+		}
+	}
+	return sb.String()
+}
+
+// requireText returns an error describing what the answer holds instead,
+// e.g. "answer has no text; got 1 functionCall (get_weather), finish reason
+// STOP", when its text is empty (--fail-if-empty-text).
+func (r *GenerateContentResponse) requireText() error {
+	if strings.TrimSpace(r.Text()) != "" {
+		return nil
+	}
+	if len(r.Candidates) == 0 {
+		return fmt.Errorf("answer has no text; got no candidates, the prompt may have been blocked")
+	}
+	var calls, mimeTypes []string
+	thoughts, emptyText := 0, 0
+	for _, p := range r.Candidates[0].Content.Parts {
+		switch {
+		case p.Thought:
+			thoughts++
+		case p.FunctionCall != nil:
+			calls = append(calls, p.FunctionCall.Name)
+		case p.InlineData != nil:
+			mimeTypes = append(mimeTypes, p.InlineData.MIMEType)
+		default:
+			emptyText++
+		}
+	}
+	var got []string
+	if len(calls) > 0 {
+		got = append(got, fmt.Sprintf("%d functionCall (%s)", len(calls), strings.Join(calls, ", ")))
+	}
+	if len(mimeTypes) > 0 {
+		got = append(got, fmt.Sprintf("%d inlineData (%s)", len(mimeTypes), strings.Join(mimeTypes, ", ")))
+	}
+	if thoughts > 0 {
+		got = append(got, fmt.Sprintf("%d thought", thoughts))
+	}
+	if emptyText > 0 {
+		got = append(got, fmt.Sprintf("%d empty text", emptyText))
+	}
+	if len(got) == 0 {
+		got = append(got, "no parts")
+	}
+	return fmt.Errorf("answer has no text; got %s, finish reason %s", strings.Join(got, ", "), cmp.Or(r.Candidates[0].FinishReason, "UNSPECIFIED"))
 }
 
 func makeAPIRequest(apiKey, method, endpointURL string, body io.Reader, target interface{}) error {
-	client := &http.Client{}
-	fullURL := fmt.Sprintf("%s%s?key=%s", baseURL, endpointURL, apiKey)
+	responseBody, err := doAPIRequest(apiKey, method, endpointURL, body)
+	if err != nil {
+		return err
+	}
+
+	if target != nil {
+		if err := json.Unmarshal(responseBody, target); err != nil {
+			return fmt.Errorf("failed to unmarshal response into target: %w. Raw response: %s", err, string(responseBody))
+		}
+	} else {
+		// Output raw JSON response body if no target for unmarshalling
+		fmt.Println(string(responseBody))
+	}
+	return nil
+}
+
+// doAPIRequest performs the request and returns the raw response body.
+func doAPIRequest(apiKey, method, endpointURL string, body io.Reader) ([]byte, error) {
+	return doAPIRequestContext(context.Background(), apiKey, method, endpointURL, body)
+}
+
+// contextWithOptionalTimeout returns a context that expires after timeout, or
+// one that never expires if timeout is zero.
+func contextWithOptionalTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// doAPIRequestContext is doAPIRequest with a context that can cancel the
+// request. With --key-rotation, apiKey is ignored in favour of the key pool.
+func doAPIRequestContext(ctx context.Context, apiKey, method, endpointURL string, body io.Reader) ([]byte, error) {
+	if keyRotation != "" {
+		return doPooledAPIRequest(ctx, method, endpointURL, body)
+	}
+	return sendAPIRequest(ctx, apiKey, method, endpointURL, body)
+}
 
-	req, err := http.NewRequest(method, fullURL, body)
+// sendAPIRequest sends one request with apiKey.
+func sendAPIRequest(ctx context.Context, apiKey, method, endpointURL string, body io.Reader) ([]byte, error) {
+	client, err := getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	separator := "?"
+	if strings.Contains(endpointURL, "?") {
+		separator = "&"
+	}
+	fullURL := fmt.Sprintf("%s%s%skey=%s", baseURL(), endpointURL, separator, apiKey)
+
+	if httpMethodOverride != "" && httpMethodOverride != method {
+		fmt.Fprintf(os.Stderr, "Debug: sending %s %s as %s (--http-method)\n", method, endpointURL, httpMethodOverride)
+		method = httpMethodOverride
+	}
+	req, err := http.NewRequestWithContext(ctx, method, fullURL, body)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req, finishTrace := traceRequest(req, method+" "+endpointURL)
+	status := 0
+	defer func() { finishTrace(status) }()
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to execute request: %w", err)
+		return nil, fmt.Errorf("failed to execute request: %w", maskURLErrorKey(err, apiKey))
 	}
 	defer resp.Body.Close()
+	status = resp.StatusCode
 
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API error: %s, Body: %s", resp.Status, string(responseBody))
+		return nil, &APIError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       string(responseBody),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
+	return responseBody, nil
+}
 
-	if target != nil {
-		if err := json.Unmarshal(responseBody, target); err != nil {
-			return fmt.Errorf("failed to unmarshal response into target: %w. Raw response: %s", err, string(responseBody))
+// maskURLErrorKey masks apiKey in the URL that a *url.Error repeats in its
+// message, so transport errors can be printed and retried without leaking it.
+func maskURLErrorKey(err error, apiKey string) error {
+	var urlErr *url.Error
+	if apiKey != "" && errors.As(err, &urlErr) {
+		urlErr.URL = strings.ReplaceAll(urlErr.URL, "key="+apiKey, "key="+maskAPIKey(apiKey))
+	}
+	return err
+}
+
+// APIError is a non-200 response from the API.
+type APIError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	RetryAfter time.Duration // Zero if the response had no Retry-After header
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error: %s, Body: %s", e.Status, e.Body)
+}
+
+// parseRetryAfter accepts both the delay-seconds and HTTP-date forms.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
 		}
-	} else {
-		// Output raw JSON response body if no target for unmarshalling
-		fmt.Println(string(responseBody))
+	}
+	return 0
+}
+
+// buildInlineFilePart loads a file argument (see processFileArgument) into an
+// inline_data part, applying any part processing options.
+func buildInlineFilePart(fileArg string, partsInput PartsInput) (Part, error) {
+	mimeType, data, err := processFileArgument(fileArg)
+	if err != nil {
+		return Part{}, fmt.Errorf("failed to process file argument '%s': %w", fileArg, err)
+	}
+	if partsInput.StripImageMetadata {
+		data, err = stripImageMetadata(mimeType, data)
+		if err != nil {
+			return Part{}, fmt.Errorf("failed to strip metadata from '%s': %w", fileArg, err)
+		}
+	}
+	if partsInput.TrimParts && strings.HasPrefix(mimeType, "text/") {
+		data, err = trimTextData(data)
+		if err != nil {
+			return Part{}, fmt.Errorf("failed to trim '%s': %w", fileArg, err)
+		}
+	}
+	return Part{InlineData: &InlinePart{MIMEType: mimeType, Data: data}}, nil
+}
+
+// v1betaOnlyFeatures lists what req uses that the v1 API may not support yet.
+func v1betaOnlyFeatures(req *GenerateContentRequest) []string {
+	var features []string
+	if req.GenerationConfig != nil && req.GenerationConfig.ThinkingConfig != nil {
+		features = append(features, "thinking config")
+	}
+	for _, tool := range req.Tools {
+		switch {
+		case tool.URLContext != nil:
+			features = append(features, "URL context tool")
+		case tool.GoogleSearch != nil:
+			features = append(features, "Google Search tool")
+		case tool.GoogleSearchRetrieval != nil:
+			features = append(features, "Google Search retrieval tool")
+		}
+	}
+	if req.GenerationConfig != nil && req.GenerationConfig.ResponseJSONSchema != nil {
+		features = append(features, "responseJsonSchema")
+	}
+	if req.CachedContent != "" {
+		features = append(features, "cached content")
+	}
+	for _, content := range req.Contents {
+		if slices.ContainsFunc(content.Parts, func(p Part) bool { return p.FileData != nil }) {
+			features = append(features, "uploaded files")
+			break
+		}
+	}
+	return features
+}
+
+// attachmentKind names a file part by its MIME type for labels such as
+// "Image 1 (floorplan):".
+func attachmentKind(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "Image"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "Audio"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "Video"
+	case mimeType == "application/pdf":
+		return "Document"
+	}
+	return "File"
+}
+
+// parseGenerationConfig unmarshals a --generation-config JSON object into
+// cfg. Fields this CLI does not know are dropped with a warning rather than
+// sent, so typos don't pass silently.
+func parseGenerationConfig(content string, cfg *GenerationConfig) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &fields); err != nil {
+		return fmt.Errorf("generation-config must be a JSON object: %w", err)
+	}
+	if err := json.Unmarshal([]byte(content), cfg); err != nil {
+		return fmt.Errorf("invalid generation-config: %w", err)
+	}
+
+	known := map[string]bool{}
+	t := reflect.TypeOf(*cfg)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		known[name] = true
+	}
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		fmt.Fprintf(os.Stderr, "Warning: ignoring unknown generation-config field(s): %s\n", strings.Join(unknown, ", "))
 	}
 	return nil
 }
 
+// readTextFilePart loads a file argument (see processFileArgument) as text,
+// whatever MIME type it was detected as, decoding it from
+// partsInput.TextEncoding.
+func readTextFilePart(fileArg string, partsInput PartsInput) (string, error) {
+	_, data, err := processFileArgument(fileArg)
+	if err != nil {
+		return "", fmt.Errorf("failed to process file argument '%s': %w", fileArg, err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode '%s': %w", fileArg, err)
+	}
+	if looksBinary(raw, partsInput.TextEncoding) {
+		fmt.Fprintf(os.Stderr, "Warning: '%s' looks like binary data but is being sent as text\n", fileArg)
+	}
+	text, err := decodeText(raw, partsInput.TextEncoding)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode '%s' as %s: %w", fileArg, partsInput.TextEncoding, err)
+	}
+	if partsInput.TrimParts {
+		text = strings.TrimSpace(text)
+	}
+	return text, nil
+}
+
+// dedupeParts drops parts whose content matches an earlier part, keeping the
+// first occurrence in place. A dropped file part takes its label with it, so
+// the remaining labels are numbered without gaps. File and text-file parts are
+// loaded first, so they are compared by content rather than by path. It
+// returns the remaining parts and how many were removed.
+func dedupeParts(parts []ParsedPart, partsInput PartsInput) ([]ParsedPart, int, error) {
+	seen := make(map[[sha256.Size]byte]bool)
+	var kept []ParsedPart
+	for _, p := range parts {
+		if err := loadPart(&p, partsInput); err != nil {
+			return nil, 0, err
+		}
+		var part Part
+		switch {
+		case p.FileURI != "":
+			part = Part{FileData: &FileDataPart{MIMEType: p.MIMEType, FileURI: p.FileURI}}
+		case p.Loaded != nil:
+			part = *p.Loaded
+		default:
+			part = Part{Text: &p.Value}
+		}
+		encoded, err := json.Marshal(part)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to encode part: %w", err)
+		}
+		sum := sha256.Sum256(encoded)
+		if seen[sum] {
+			continue
+		}
+		seen[sum] = true
+		kept = append(kept, p)
+	}
+	return kept, len(parts) - len(kept), nil
+}
+
+// unlistedPropertiesWarning keeps the --property-order warning to one per run
+// when many requests are built, e.g. with --parts-from-csv.
+var unlistedPropertiesWarning sync.Once
+
 func buildGenerateContentRequest(
-	systemInstructionStr string,
+	systemInstructions []string,
 	parsedParts []ParsedPart,
+	partsInput PartsInput,
 	genConfigInput GenerationConfigInput,
 	toolsInput ToolsInput,
-	safetySettingsStr string) (*GenerateContentRequest, error) {
+	safetySettingsStr string,
+	defaultSafetySettings map[string]string) (*GenerateContentRequest, error) {
 
 	req := &GenerateContentRequest{}
 	var genCfg GenerationConfig
 	genCfgChanged := false
+	if genConfigInput.GenerationConfigFileOrJSON != "" {
+		content, err := readFileOrString(genConfigInput.GenerationConfigFileOrJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read generation-config: %w", err)
+		}
+		if err := parseGenerationConfig(content, &genCfg); err != nil {
+			return nil, err
+		}
+		genCfgChanged = true
+	}
 
-	if systemInstructionStr != "" {
-		req.SystemInstruction = &SystemInstruction{
-			Parts: []TextPart{{Text: systemInstructionStr}},
+	if len(systemInstructions) > 0 || len(partsInput.SystemInstructionFiles) > 0 {
+		var sysParts []Part
+		for _, text := range systemInstructions {
+			textVal := text
+			sysParts = append(sysParts, Part{Text: &textVal})
+		}
+		for _, fileArg := range partsInput.SystemInstructionFiles {
+			part, err := buildInlineFilePart(fileArg, partsInput)
+			if err != nil {
+				return nil, fmt.Errorf("system instruction: %w", err)
+			}
+			sysParts = append(sysParts, part)
 		}
+		req.SystemInstruction = &SystemInstruction{Parts: sysParts}
 	}
 
 	if len(parsedParts) > 0 {
 		var apiParts []Part
+		attachmentCounts := map[string]int{}
 		for _, p := range parsedParts {
 			switch p.Type {
-			case "text":
+			case "text", "text-file":
 				textVal := p.Value
+				switch {
+				case p.Loaded != nil:
+					textVal = *p.Loaded.Text
+				case p.Type == "text-file":
+					var err error
+					textVal, err = readTextFilePart(p.Value, partsInput)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if partsInput.ConcatText && len(apiParts) > 0 && apiParts[len(apiParts)-1].Text != nil {
+					joined := *apiParts[len(apiParts)-1].Text + partsInput.ConcatSeparator + textVal
+					apiParts[len(apiParts)-1].Text = &joined
+					continue
+				}
 				apiParts = append(apiParts, Part{Text: &textVal})
 			case "file":
-				mimeType, data, err := processFileArgument(p.Value)
-				if err != nil {
-					return nil, fmt.Errorf("failed to process file argument '%s': %w", p.Value, err)
+				var part Part
+				var mimeType string
+				if p.FileURI != "" { // Resolved Files API reference
+					part = Part{FileData: &FileDataPart{MIMEType: p.MIMEType, FileURI: p.FileURI}}
+					mimeType = p.MIMEType
+				} else if p.Loaded != nil {
+					part = *p.Loaded
+					mimeType = part.InlineData.MIMEType
+				} else {
+					var err error
+					part, err = buildInlineFilePart(p.Value, partsInput)
+					if err != nil {
+						return nil, err
+					}
+					mimeType = part.InlineData.MIMEType
+				}
+				kind := attachmentKind(mimeType)
+				attachmentCounts[kind]++
+				if p.Label != "" {
+					label := fmt.Sprintf("%s %d (%s):", kind, attachmentCounts[kind], p.Label)
+					apiParts = append(apiParts, Part{Text: &label})
 				}
-				apiParts = append(apiParts, Part{InlineData: &InlinePart{MIMEType: mimeType, Data: data}})
+				apiParts = append(apiParts, part)
 			default:
 				return nil, fmt.Errorf("unknown parsed part type: %s", p.Type)
 			}
 		}
 		req.Contents = []Content{{Parts: apiParts}}
-	} else if systemInstructionStr == "" {
+	} else if req.SystemInstruction == nil {
 		return nil, fmt.Errorf("at least one input part or system instruction is required")
 	}
 
@@ -204,12 +724,58 @@ func buildGenerateContentRequest(
 		if err != nil {
 			return nil, fmt.Errorf("failed to read response-schema: %w", err)
 		}
+		if genConfigInput.ResolveSchemaRefs {
+			schemaContent, err = resolveSchemaRefs(schemaContent)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if genConfigInput.ResponseSchemaPatch != "" {
+			patch, err := readFileOrString(genConfigInput.ResponseSchemaPatch)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read response-schema-patch: %w", err)
+			}
+			schemaContent, err = mergeSchemaPatch(schemaContent, patch)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(genConfigInput.PropertyOrder) > 0 {
+			var unlisted []string
+			schemaContent, unlisted, err = applyPropertyOrder(schemaContent, genConfigInput.PropertyOrder)
+			if err != nil {
+				return nil, err
+			}
+			if len(unlisted) > 0 {
+				unlistedPropertiesWarning.Do(func() {
+					fmt.Fprintf(os.Stderr, "Warning: --property-order doesn't list %s; placed after the listed properties\n", strings.Join(unlisted, ", "))
+				})
+			}
+		}
+		if genConfigInput.StrictSchema {
+			schemaContent, err = addPropertyOrdering(schemaContent)
+			if err != nil {
+				return nil, fmt.Errorf("failed to apply strict schema: %w", err)
+			}
+		}
 		genCfg.ResponseSchema = json.RawMessage(schemaContent)
 		genCfgChanged = true
 	}
+	if len(genConfigInput.ResponseEnum) > 0 {
+		genCfg.ResponseSchema = enumSchema(genConfigInput.ResponseEnum)
+		genCfgChanged = true
+	}
+	if genConfigInput.PermissiveJSONSchema && genCfg.ResponseSchema == nil && genCfg.ResponseJSONSchema == nil {
+		// The OpenAPI subset can't express "any object", so use JSON Schema
+		genCfg.ResponseJSONSchema = json.RawMessage(`{"type":"object"}`)
+		genCfgChanged = true
+	}
 
 	// Thinking Config
 	var thinkingCfg ThinkingConfig
+	if genCfg.ThinkingConfig != nil {
+		thinkingCfg = *genCfg.ThinkingConfig
+	}
 	thinkingCfgChanged := false
 	if genConfigInput.ThinkingBudget >= 0 {
 		tb := genConfigInput.ThinkingBudget
@@ -232,6 +798,17 @@ func buildGenerateContentRequest(
 
 	// --- Populate Tools ---
 	var tools []Tool
+	if toolsInput.FunctionDeclarationsFileOrJSON != "" {
+		declarations, err := readFileOrString(toolsInput.FunctionDeclarationsFileOrJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read function declarations: %w", err)
+		}
+		var check []json.RawMessage
+		if err := json.Unmarshal([]byte(declarations), &check); err != nil {
+			return nil, fmt.Errorf("function declarations must be a JSON array: %w", err)
+		}
+		tools = append(tools, Tool{FunctionDeclarations: json.RawMessage(declarations)})
+	}
 	if toolsInput.EnableURLContext {
 		tools = append(tools, Tool{URLContext: &map[string]interface{}{}})
 	}
@@ -268,24 +845,118 @@ func buildGenerateContentRequest(
 		req.Tools = tools
 	}
 
+	// --- Populate ToolConfig ---
+	if toolsInput.FunctionCallingMode != "" || toolsInput.AllowedFunctions != "" {
+		mode := strings.ToUpper(toolsInput.FunctionCallingMode)
+		switch mode {
+		case "", "AUTO", "ANY", "NONE":
+		default:
+			return nil, fmt.Errorf("invalid function calling mode '%s'. Must be AUTO, ANY or NONE", toolsInput.FunctionCallingMode)
+		}
+		fcConfig := &FunctionCallingConfig{Mode: mode}
+		for _, name := range strings.Split(toolsInput.AllowedFunctions, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				fcConfig.AllowedFunctionNames = append(fcConfig.AllowedFunctionNames, name)
+			}
+		}
+		if len(fcConfig.AllowedFunctionNames) > 0 && mode != "ANY" {
+			return nil, fmt.Errorf("--allowed-functions requires --function-calling-mode ANY")
+		}
+		req.ToolConfig = &ToolConfig{FunctionCallingConfig: fcConfig}
+	}
+
 	// --- Populate Safety Settings ---
-	if safetySettingsStr != "" {
-		pairs := strings.Split(safetySettingsStr, ",")
-		for _, pair := range pairs {
-			parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
-			if len(parts) == 2 {
-				category := strings.TrimSpace(parts[0])
-				threshold := strings.TrimSpace(parts[1])
-				if category != "" && threshold != "" {
-					req.SafetySettings = append(req.SafetySettings, SafetySetting{Category: category, Threshold: threshold})
-				} else {
-					return nil, fmt.Errorf("invalid safety setting pair: '%s'. Must be CATEGORY:THRESHOLD", pair)
+	// Command-line settings come first; stored defaults fill in any category
+	// the command line did not mention.
+	cliSettings, err := parseSafetySettings(safetySettingsStr)
+	if err != nil {
+		return nil, err
+	}
+	req.SafetySettings = mergeSafetySettings(cliSettings, defaultSafetySettings)
+
+	return req, nil
+}
+
+// safetyOption is a documented value for a safety setting field.
+type safetyOption struct {
+	Name        string
+	Description string
+}
+
+// safetyCategories and safetyThresholds are the values --safety-settings
+// accepts.
+var safetyCategories = []safetyOption{
+	{"HARM_CATEGORY_HARASSMENT", "Negative or harmful comments targeting identity or protected attributes"},
+	{"HARM_CATEGORY_HATE_SPEECH", "Content that is rude, disrespectful, or profane"},
+	{"HARM_CATEGORY_SEXUALLY_EXPLICIT", "References to sexual acts or other lewd content"},
+	{"HARM_CATEGORY_DANGEROUS_CONTENT", "Promotes, facilitates, or encourages harmful acts"},
+	{"HARM_CATEGORY_CIVIC_INTEGRITY", "Election-related queries"},
+}
+
+var safetyThresholds = []safetyOption{
+	{"BLOCK_LOW_AND_ABOVE", "Block when the probability of harm is low, medium or high"},
+	{"BLOCK_MEDIUM_AND_ABOVE", "Block when the probability of harm is medium or high"},
+	{"BLOCK_ONLY_HIGH", "Block only when the probability of harm is high"},
+	{"BLOCK_NONE", "Always show content, but still return safety ratings"},
+	{"OFF", "Turn the safety filter off"},
+}
+
+func isSafetyOption(options []safetyOption, name string) bool {
+	for _, o := range options {
+		if o.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSafetySettings(safetySettingsStr string) ([]SafetySetting, error) {
+	var settings []SafetySetting
+	if safetySettingsStr == "" {
+		return nil, nil
+	}
+	pairs := strings.Split(safetySettingsStr, ",")
+	for _, pair := range pairs {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) == 2 {
+			category := strings.TrimSpace(parts[0])
+			threshold := strings.TrimSpace(parts[1])
+			if category != "" && threshold != "" {
+				if !isSafetyOption(safetyCategories, category) {
+					return nil, fmt.Errorf("unknown safety category '%s'. Run list-safety-options to see valid values", category)
+				}
+				if !isSafetyOption(safetyThresholds, threshold) {
+					return nil, fmt.Errorf("unknown safety threshold '%s'. Run list-safety-options to see valid values", threshold)
 				}
-			} else if strings.TrimSpace(pair) != "" { // Allow if only one non-empty pair and it's invalid
-				return nil, fmt.Errorf("invalid safety setting format: '%s'. Must be CATEGORY:THRESHOLD", pair)
+				settings = append(settings, SafetySetting{Category: category, Threshold: threshold})
+			} else {
+				return nil, fmt.Errorf("invalid safety setting pair: '%s'. Must be CATEGORY:THRESHOLD", pair)
 			}
+		} else if strings.TrimSpace(pair) != "" { // Allow if only one non-empty pair and it's invalid
+			return nil, fmt.Errorf("invalid safety setting format: '%s'. Must be CATEGORY:THRESHOLD", pair)
 		}
 	}
+	return settings, nil
+}
 
-	return req, nil
+// mergeSafetySettings overlays command-line settings on the stored defaults.
+// A category given on the command line replaces the default for that category;
+// defaults for other categories are appended in sorted order.
+func mergeSafetySettings(cliSettings []SafetySetting, defaults map[string]string) []SafetySetting {
+	merged := append([]SafetySetting(nil), cliSettings...)
+	seen := make(map[string]bool, len(cliSettings))
+	for _, s := range cliSettings {
+		seen[s.Category] = true
+	}
+	categories := make([]string, 0, len(defaults))
+	for category := range defaults {
+		if !seen[category] {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		merged = append(merged, SafetySetting{Category: category, Threshold: defaults[category]})
+	}
+	return merged
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchmarkResult is the outcome of a single benchmark request.
+type benchmarkResult struct {
+	Latency      time.Duration
+	OutputTokens int
+	Attempts     int
+	Err          error
+}
+
+// benchmarkPrompt fills in the {{n}} placeholder with the 1-based request number.
+func benchmarkPrompt(template string, n int) string {
+	return strings.ReplaceAll(template, "{{n}}", strconv.Itoa(n))
+}
+
+// runBenchmarkRequest sends one generateContent request and times it,
+// including any retries.
+func runBenchmarkRequest(apiKey, endpoint, prompt string, benchInput BenchmarkInput, retryInput RetryInput) benchmarkResult {
+	req := GenerateContentRequest{Contents: []Content{{Parts: []Part{{Text: &prompt}}}}}
+	if benchInput.MaxOutputTokens >= 0 {
+		m := benchInput.MaxOutputTokens
+		req.GenerationConfig = &GenerationConfig{MaxOutputTokens: &m}
+	}
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return benchmarkResult{Err: fmt.Errorf("failed to marshal request: %w", err)}
+	}
+
+	var stats retryStats
+	start := time.Now()
+	responseBody, err := postWithRetry(apiKey, endpoint, jsonData, retryInput, &stats)
+	result := benchmarkResult{Latency: time.Since(start), Attempts: stats.Attempts, Err: err}
+	if err != nil {
+		return result
+	}
+
+	var response GenerateContentResponse
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		result.Err = fmt.Errorf("failed to parse response: %w", err)
+		return result
+	}
+	if response.UsageMetadata != nil {
+		result.OutputTokens = response.UsageMetadata.CandidatesTokenCount + response.UsageMetadata.ThoughtsTokenCount
+	}
+	return result
+}
+
+// percentile returns the nearest-rank percentile p (0-100) of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(float64(len(sorted))*p/100+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func handleBenchmark(apiKey, modelName, promptTemplate string, benchInput BenchmarkInput, retryInput RetryInput) {
+	if !strings.HasPrefix(modelName, "models/") {
+		modelName = "models/" + modelName
+	}
+	endpoint := fmt.Sprintf("/%s:generateContent", modelName)
+
+	results := make([]benchmarkResult, benchInput.Requests)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < benchInput.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = runBenchmarkRequest(apiKey, endpoint, benchmarkPrompt(promptTemplate, i+1), benchInput, retryInput)
+				if results[i].Err != nil {
+					fmt.Fprintf(os.Stderr, "Request %d failed: %v\n", i+1, results[i].Err)
+				}
+			}
+		}()
+	}
+	for i := 0; i < benchInput.Requests; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	wall := time.Since(start)
+
+	var latencies []time.Duration
+	var totalTokens, attempts, failed int
+	var tokenRateSum float64
+	for _, r := range results {
+		attempts += r.Attempts
+		if r.Err != nil {
+			failed++
+			continue
+		}
+		latencies = append(latencies, r.Latency)
+		totalTokens += r.OutputTokens
+		if r.Latency > 0 {
+			tokenRateSum += float64(r.OutputTokens) / r.Latency.Seconds()
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	if display := parseModelName(modelName).String(); display != "" {
+		fmt.Printf("Model:       %s (%s)\n", modelName, display)
+	} else {
+		fmt.Printf("Model:       %s\n", modelName)
+	}
+	fmt.Printf("Requests:    %d (%d ok, %d failed, %.1f%% error rate), concurrency %d\n",
+		benchInput.Requests, len(latencies), failed, float64(failed)*100/float64(benchInput.Requests), benchInput.Concurrency)
+	fmt.Printf("Attempts:    %d (including retries)\n", attempts)
+	fmt.Printf("Wall time:   %s\n", wall.Round(time.Millisecond))
+	if len(latencies) == 0 {
+		fatalf("Error: all %d requests failed", benchInput.Requests)
+	}
+	fmt.Printf("Latency:     p50 %s, p90 %s, p99 %s\n",
+		percentile(latencies, 50).Round(time.Millisecond), percentile(latencies, 90).Round(time.Millisecond), percentile(latencies, 99).Round(time.Millisecond))
+	fmt.Printf("Tokens/sec:  %.1f aggregate, %.1f mean per request (output incl. thinking)\n",
+		float64(totalTokens)/wall.Seconds(), tokenRateSum/float64(len(latencies)))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CachedContent is a cachedContents resource. Only the system instruction is
+// cached by this CLI.
+type CachedContent struct {
+	Name              string              `json:"name,omitempty"`
+	DisplayName       string              `json:"displayName,omitempty"`
+	Model             string              `json:"model"`
+	SystemInstruction *SystemInstruction  `json:"systemInstruction,omitempty"`
+	TTL               string              `json:"ttl,omitempty"`
+	CreateTime        string              `json:"createTime,omitempty"`
+	ExpireTime        string              `json:"expireTime,omitempty"`
+	UsageMetadata     *CachedContentUsage `json:"usageMetadata,omitempty"`
+}
+
+type CachedContentUsage struct {
+	TotalTokenCount int `json:"totalTokenCount"`
+}
+
+// cachedContentName normalizes "abc123" or "cachedContents/abc123" to the
+// resource name.
+func cachedContentName(name string) string {
+	if strings.HasPrefix(name, "cachedContents/") {
+		return name
+	}
+	return "cachedContents/" + name
+}
+
+// updateCachedContentTTL sets a cache to expire ttl from now.
+func updateCachedContentTTL(apiKey, name string, ttl time.Duration) (*CachedContent, error) {
+	body, err := json.Marshal(map[string]string{"ttl": fmt.Sprintf("%ds", int64(ttl.Seconds()))})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cachedContent: %w", err)
+	}
+
+	var updated CachedContent
+	if err := makeAPIRequest(apiKey, "PATCH", "/"+cachedContentName(name)+"?updateMask=ttl", bytes.NewReader(body), &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func createCachedContent(apiKey, modelName, systemInstruction, displayName string, ttl time.Duration) (*CachedContent, error) {
+	if !strings.HasPrefix(modelName, "models/") {
+		modelName = "models/" + modelName
+	}
+	cache := CachedContent{
+		Model:             modelName,
+		DisplayName:       displayName,
+		SystemInstruction: &SystemInstruction{Parts: []Part{{Text: &systemInstruction}}},
+		TTL:               fmt.Sprintf("%ds", int64(ttl.Seconds())),
+	}
+	body, err := json.Marshal(cache)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cachedContent: %w", err)
+	}
+
+	var created CachedContent
+	if err := makeAPIRequest(apiKey, "POST", "/cachedContents", bytes.NewReader(body), &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// A cassette stores raw API responses keyed by a hash of the request, so a
+// later run can replay them without hitting the network.
+type Cassette struct {
+	Entries map[string]CassetteEntry `json:"entries"`
+}
+
+type CassetteEntry struct {
+	Model      string          `json:"model"`
+	Endpoint   string          `json:"endpoint"`
+	RecordedAt time.Time       `json:"recorded_at"`
+	Response   json.RawMessage `json:"response"`
+}
+
+// Helper struct to pass parsed CLI flags for record/replay
+type CassetteInput struct {
+	RecordPath string
+	ReplayPath string
+}
+
+func requestHash(endpoint string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(endpoint))
+	h.Write([]byte{'\n'})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cloneRequest returns a deep copy of req, so it can be kept as the cassette
+// key request while req's parts are routed to the Files API.
+func cloneRequest(req *GenerateContentRequest) (*GenerateContentRequest, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	var clone GenerateContentRequest
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, fmt.Errorf("failed to copy request: %w", err)
+	}
+	return &clone, nil
+}
+
+// promptHash is a stable hash of the model and request for external caches.
+// The request is re-encoded with sorted object keys so the hash does not
+// depend on field order.
+func promptHash(modelName string, req *GenerateContentRequest) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var canonical interface{}
+	if err := dec.Decode(&canonical); err != nil {
+		return "", fmt.Errorf("failed to canonicalize request: %w", err)
+	}
+	canonicalJSON, err := json.Marshal(map[string]interface{}{
+		"model":   strings.TrimPrefix(modelName, "models/"),
+		"request": canonical,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to canonicalize request: %w", err)
+	}
+	sum := sha256.Sum256(canonicalJSON)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func loadCassette(path string) (*Cassette, error) {
+	cassette := &Cassette{Entries: map[string]CassetteEntry{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cassette, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, cassette); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cassette from %s: %w", path, err)
+	}
+	if cassette.Entries == nil {
+		cassette.Entries = map[string]CassetteEntry{}
+	}
+	return cassette, nil
+}
+
+func replayResponse(path, key string) ([]byte, bool, error) {
+	cassette, err := loadCassette(path)
+	if err != nil {
+		return nil, false, err
+	}
+	entry, ok := cassette.Entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	return entry.Response, true, nil
+}
+
+func recordResponse(path, key, model, endpoint string, response []byte) error {
+	cassette, err := loadCassette(path)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(response) {
+		return fmt.Errorf("refusing to record non-JSON response")
+	}
+	cassette.Entries[key] = CassetteEntry{
+		Model:      model,
+		Endpoint:   endpoint,
+		RecordedAt: time.Now().UTC(),
+		Response:   json.RawMessage(response),
+	}
+	data, err := json.MarshalIndent(cassette, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal cassette: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write cassette file %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// charsPerToken is the usual rough size of a token in English text. Chunking
+// uses it to size chunks without a countTokens call per candidate split.
+const charsPerToken = 4
+
+// splitTextChunks splits text into chunks of about chunkTokens tokens, each
+// starting about overlapTokens before the end of the previous one. Chunks end
+// at a paragraph break, line break or space where one falls in their second
+// half.
+func splitTextChunks(text string, chunkTokens, overlapTokens int) []string {
+	runes := []rune(text)
+	size := chunkTokens * charsPerToken
+	overlap := overlapTokens * charsPerToken
+
+	var chunks []string
+	for start := 0; start < len(runes); {
+		end := min(start+size, len(runes))
+		if end < len(runes) {
+			end = chunkBreak(runes, start, end)
+		}
+		chunks = append(chunks, string(runes[start:end]))
+		if end == len(runes) {
+			break
+		}
+		// Start the overlap at a word boundary
+		next := max(end-overlap, start+1)
+		for next < end && !unicode.IsSpace(runes[next-1]) {
+			next++
+		}
+		start = next
+	}
+	return chunks
+}
+
+// chunkBreak moves end back to just after the last paragraph break, line
+// break or space in the second half of runes[start:end], preferring them in
+// that order. It returns end unchanged if there is none.
+func chunkBreak(runes []rune, start, end int) int {
+	half := start + (end-start)/2
+	window := string(runes[half:end])
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if i := strings.LastIndex(window, sep); i >= 0 {
+			return half + len([]rune(window[:i+len(sep)]))
+		}
+	}
+	return end
+}
+
+// handleChunkedGenerate splits the single text-file part into chunks and sends
+// one generate request per chunk, with every other part, the system
+// instruction and the generation settings shared. The answers are printed in
+// order, separated by blank lines.
+func handleChunkedGenerate(run *generateRun, parsedParts []ParsedPart, chunkInput ChunkInput) {
+	docIndex := -1
+	for i, p := range parsedParts {
+		if p.Type == "text-file" {
+			if docIndex >= 0 {
+				fatalf("Error: --split-chunks needs exactly one text-file part to split, got more than one")
+			}
+			docIndex = i
+		}
+	}
+	if docIndex < 0 {
+		fatalf("Error: --split-chunks needs a text-file part to split")
+	}
+	if err := run.loadParts(parsedParts); err != nil {
+		fatalf("Error reading parts: %v", err)
+	}
+	chunks := splitTextChunks(*parsedParts[docIndex].Loaded.Text, chunkInput.ChunkTokens, chunkInput.ChunkOverlap)
+	if len(chunks) == 0 {
+		fatalf("Error: '%s' is empty", parsedParts[docIndex].Value)
+	}
+
+	answers := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		if run.outputInput.Verbose {
+			fmt.Fprintf(os.Stderr, "Chunk %d/%d: %d characters\n", i+1, len(chunks), len([]rune(chunk)))
+		}
+		chunkParts := append([]ParsedPart(nil), parsedParts...)
+		chunkParts[docIndex] = ParsedPart{Type: "text", Value: chunk}
+
+		requestPayload, err := run.buildRequest(run.systemInstructionStr, chunkParts, run.genConfigInput)
+		if err != nil {
+			fatalf("Error building request for chunk %d: %v", i+1, err)
+		}
+		response, _, err := run.send(requestPayload)
+		if err != nil {
+			fatalf("Error: chunk %d: %v", i+1, err)
+		}
+		answers[i] = response.Text()
+		if run.outputInput.StripMarkdown {
+			answers[i] = stripMarkdown(answers[i])
+		}
+	}
+
+	fmt.Println(strings.Join(answers, "\n\n"))
+	run.printSummary()
+}
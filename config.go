@@ -5,67 +5,224 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type Config struct {
 	APIKey string `json:"api_key"`
+	// Keys used in turn with --key-rotation.
+	APIKeyPool []string `json:"api_key_pool,omitempty"`
+	// Default safety thresholds keyed by harm category. Settings passed with
+	// --safety-settings override the default for the same category.
+	SafetySettings map[string]string `json:"safety_settings,omitempty"`
+	// Base system instruction sent before any --system-instruction.
+	SystemInstruction string `json:"system_instruction,omitempty"`
+	// Output format used by generate when --format is not given.
+	DefaultOutputFormat string `json:"default_output_format,omitempty"`
+	// Per-model pricing overrides for --estimate-cost, keyed by model name prefix.
+	Pricing map[string]ModelPricing `json:"pricing,omitempty"`
 }
 
+// noStore keeps the CLI off the disk: the config file is neither read nor
+// written, and options that write files are refused.
+var noStore bool
+
+// getConfigPath returns the config file path without creating anything, so
+// reading works on a read-only filesystem. Writers create the directory with
+// ensureConfigDir.
 func getConfigPath() (string, error) {
 	configDir, err := os.UserConfigDir()
 	if err != nil {
 		return "", fmt.Errorf("failed to get user config directory: %w", err)
 	}
-	appConfigDir := filepath.Join(configDir, "gemini-cli")
-	if err := os.MkdirAll(appConfigDir, 0700); err != nil {
-		return "", fmt.Errorf("failed to create app config directory %s: %w", appConfigDir, err)
+	return filepath.Join(configDir, "gemini-cli", "config.json"), nil
+}
+
+func ensureConfigDir(configPath string) error {
+	if noStore {
+		return fmt.Errorf("not writing to %s with --no-store", filepath.Dir(configPath))
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
+		return fmt.Errorf("failed to create app config directory %s: %w", filepath.Dir(configPath), err)
 	}
-	return filepath.Join(appConfigDir, "config.json"), nil
+	return nil
 }
 
-func saveAPIKey(apiKey string) error {
+// loadConfig reads the config file. A missing file yields an empty config.
+func loadConfig() (*Config, string, error) {
 	configPath, err := getConfigPath()
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	config := Config{APIKey: apiKey}
+	var config Config
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return &config, configPath, nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read config file %s: %w", configPath, err)
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal config from %s: %w", configPath, err)
+	}
+	if config.DefaultOutputFormat != "" && !isValidOutputFormat(config.DefaultOutputFormat) {
+		return nil, "", fmt.Errorf("invalid default_output_format '%s' in %s", config.DefaultOutputFormat, configPath)
+	}
+	return &config, configPath, nil
+}
+
+func saveConfig(config *Config, configPath string) error {
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
 
+	if err := ensureConfigDir(configPath); err != nil {
+		return err
+	}
 	err = os.WriteFile(configPath, data, 0600)
 	if err != nil {
 		return fmt.Errorf("failed to write config file %s: %w", configPath, err)
 	}
+	return nil
+}
+
+func saveAPIKey(apiKey string) error {
+	config, configPath, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	config.APIKey = apiKey
+	if err := saveConfig(config, configPath); err != nil {
+		return err
+	}
 	fmt.Printf("API key saved to %s\n", configPath)
 	return nil
 }
 
-func loadAPIKey() (string, error) {
-	configPath, err := getConfigPath()
+func saveAPIKeyPool(keys []string) error {
+	config, configPath, err := loadConfig()
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		return "", fmt.Errorf("config file not found at %s. Run 'set-config --key YOUR_KEY' first", configPath)
+	config.APIKeyPool = keys
+	if err := saveConfig(config, configPath); err != nil {
+		return err
 	}
+	fmt.Printf("Key pool of %d key(s) saved to %s\n", len(keys), configPath)
+	return nil
+}
 
-	data, err := os.ReadFile(configPath)
+func saveSafetySettings(settings []SafetySetting) error {
+	config, configPath, err := loadConfig()
 	if err != nil {
-		return "", fmt.Errorf("failed to read config file %s: %w", configPath, err)
+		return err
 	}
 
-	var config Config
-	err = json.Unmarshal(data, &config)
+	config.SafetySettings = make(map[string]string, len(settings))
+	for _, s := range settings {
+		config.SafetySettings[s.Category] = s.Threshold
+	}
+	if err := saveConfig(config, configPath); err != nil {
+		return err
+	}
+	fmt.Printf("Default safety settings saved to %s\n", configPath)
+	return nil
+}
+
+func saveSystemInstruction(systemInstruction string) error {
+	config, configPath, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	config.SystemInstruction = systemInstruction
+	if err := saveConfig(config, configPath); err != nil {
+		return err
+	}
+	fmt.Printf("Base system instruction saved to %s\n", configPath)
+	return nil
+}
+
+func saveDefaultOutputFormat(format string) error {
+	if !isValidOutputFormat(format) {
+		return fmt.Errorf("invalid output format '%s'. Must be one of: %s", format, strings.Join(outputFormats, ", "))
+	}
+	config, configPath, err := loadConfig()
 	if err != nil {
-		return "", fmt.Errorf("failed to unmarshal config from %s: %w", configPath, err)
+		return err
+	}
+
+	config.DefaultOutputFormat = format
+	if err := saveConfig(config, configPath); err != nil {
+		return err
+	}
+	fmt.Printf("Default output format saved to %s\n", configPath)
+	return nil
+}
+
+// Environment variables that override the matching config file settings.
+const (
+	envAPIKey              = "GEMINI_API_KEY"
+	envAPIKeyPool          = "GEMINI_API_KEY_POOL"
+	envSystemInstruction   = "GEMINI_CLI_SYSTEM_INSTRUCTION"
+	envDefaultOutputFormat = "GEMINI_CLI_OUTPUT_FORMAT"
+)
+
+// resolveConfig returns the effective configuration. Environment variables
+// override the config file, which overrides built-in defaults. Command-line
+// flags are applied on top of the result by each command.
+func resolveConfig() (*Config, error) {
+	config := &Config{}
+	if !noStore {
+		var err error
+		config, _, err = loadConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v := os.Getenv(envAPIKey); v != "" {
+		config.APIKey = v
+	}
+	if v := os.Getenv(envAPIKeyPool); v != "" {
+		keys, err := parseKeyPool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envAPIKeyPool, err)
+		}
+		config.APIKeyPool = keys
 	}
+	if config.APIKey == "" && len(config.APIKeyPool) > 0 {
+		config.APIKey = config.APIKeyPool[0]
+	}
+	if v := os.Getenv(envSystemInstruction); v != "" {
+		config.SystemInstruction = v
+	}
+	if v := os.Getenv(envDefaultOutputFormat); v != "" {
+		if !isValidOutputFormat(v) {
+			return nil, fmt.Errorf("invalid %s '%s'. Must be one of: %s", envDefaultOutputFormat, v, strings.Join(outputFormats, ", "))
+		}
+		config.DefaultOutputFormat = v
+	}
+
+	if config.DefaultOutputFormat == "" {
+		config.DefaultOutputFormat = "json"
+	}
+	return config, nil
+}
 
+func loadAPIKey() (string, error) {
+	config, err := resolveConfig()
+	if err != nil {
+		return "", err
+	}
 	if config.APIKey == "" {
-		return "", fmt.Errorf("API key not found in config file %s. Run 'set-config --key YOUR_KEY'", configPath)
+		return "", fmt.Errorf("no API key found in %s or the config file", envAPIKey)
 	}
 	return config.APIKey, nil
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// setupConfigEnv points the config directory at a temporary one, clears the
+// environment variables resolveConfig reads and writes configJSON, if given,
+// as the config file.
+func setupConfigEnv(t *testing.T, configJSON string) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	for _, name := range []string{envAPIKey, envAPIKeyPool, envSystemInstruction, envDefaultOutputFormat} {
+		t.Setenv(name, "")
+	}
+	if configJSON == "" {
+		return
+	}
+	path := filepath.Join(dir, "gemini-cli", "config.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(configJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const testConfigFile = `{
+  "api_key": "file-key",
+  "api_key_pool": ["pool-a", "pool-b"],
+  "system_instruction": "from file",
+  "default_output_format": "text"
+}`
+
+func TestResolveConfigDefaults(t *testing.T) {
+	setupConfigEnv(t, "")
+	config, err := resolveConfig()
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if config.APIKey != "" || config.SystemInstruction != "" || len(config.APIKeyPool) > 0 {
+		t.Errorf("got %+v, want an empty config", config)
+	}
+	if config.DefaultOutputFormat != "json" {
+		t.Errorf("DefaultOutputFormat = %q, want the built-in json", config.DefaultOutputFormat)
+	}
+}
+
+func TestResolveConfigFileOverridesDefaults(t *testing.T) {
+	setupConfigEnv(t, testConfigFile)
+	config, err := resolveConfig()
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if config.APIKey != "file-key" {
+		t.Errorf("APIKey = %q, want file-key", config.APIKey)
+	}
+	if !slices.Equal(config.APIKeyPool, []string{"pool-a", "pool-b"}) {
+		t.Errorf("APIKeyPool = %q, want [pool-a pool-b]", config.APIKeyPool)
+	}
+	if config.SystemInstruction != "from file" {
+		t.Errorf("SystemInstruction = %q, want from file", config.SystemInstruction)
+	}
+	if config.DefaultOutputFormat != "text" {
+		t.Errorf("DefaultOutputFormat = %q, want text", config.DefaultOutputFormat)
+	}
+}
+
+func TestResolveConfigEnvOverridesFile(t *testing.T) {
+	setupConfigEnv(t, testConfigFile)
+	t.Setenv(envAPIKey, "env-key")
+	t.Setenv(envAPIKeyPool, "env-a, env-b")
+	t.Setenv(envSystemInstruction, "from env")
+	t.Setenv(envDefaultOutputFormat, "json-answer")
+	config, err := resolveConfig()
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if config.APIKey != "env-key" {
+		t.Errorf("APIKey = %q, want env-key", config.APIKey)
+	}
+	if !slices.Equal(config.APIKeyPool, []string{"env-a", "env-b"}) {
+		t.Errorf("APIKeyPool = %q, want [env-a env-b]", config.APIKeyPool)
+	}
+	if config.SystemInstruction != "from env" {
+		t.Errorf("SystemInstruction = %q, want from env", config.SystemInstruction)
+	}
+	if config.DefaultOutputFormat != "json-answer" {
+		t.Errorf("DefaultOutputFormat = %q, want json-answer", config.DefaultOutputFormat)
+	}
+}
+
+func TestResolveConfigKeyFromPool(t *testing.T) {
+	setupConfigEnv(t, "")
+	t.Setenv(envAPIKeyPool, "pool-a,pool-b")
+	config, err := resolveConfig()
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if config.APIKey != "pool-a" {
+		t.Errorf("APIKey = %q, want the first pool key", config.APIKey)
+	}
+}
+
+func TestResolveConfigInvalidEnvFormat(t *testing.T) {
+	setupConfigEnv(t, testConfigFile)
+	t.Setenv(envDefaultOutputFormat, "yaml")
+	if _, err := resolveConfig(); err == nil {
+		t.Errorf("resolveConfig accepted %s=yaml", envDefaultOutputFormat)
+	}
+}
+
+func TestResolveConfigNoStoreSkipsFile(t *testing.T) {
+	setupConfigEnv(t, testConfigFile)
+	t.Setenv(envAPIKey, "env-key")
+	noStore = true
+	t.Cleanup(func() { noStore = false })
+	config, err := resolveConfig()
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if config.APIKey != "env-key" || config.SystemInstruction != "" || config.DefaultOutputFormat != "json" {
+		t.Errorf("got %+v, want only the environment and defaults", config)
+	}
+}
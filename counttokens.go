@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+type CountTokensResponse struct {
+	TotalTokens int `json:"totalTokens"`
+	// Part of TotalTokens that comes from the cachedContent, if one was given
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+}
+
+// fileTokenCount is one row of count-tokens output.
+type fileTokenCount struct {
+	Path    string   `json:"path"`
+	Tokens  int      `json:"tokens"`
+	CostUSD *float64 `json:"estimated_cost_usd,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// expandTokenCountPaths turns file, directory and glob arguments into a sorted
+// list of regular files. Directories are walked recursively, skipping hidden
+// entries.
+func expandTokenCountPaths(args []string) ([]string, error) {
+	seen := map[string]bool{}
+	var paths []string
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+
+	for _, arg := range args {
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid glob '%s': %w", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match '%s'", arg)
+			}
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+			err = filepath.WalkDir(match, func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if p != match && strings.HasPrefix(d.Name(), ".") {
+					if d.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if d.Type().IsRegular() {
+					add(p)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to walk '%s': %w", match, err)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// countedGenerateContentRequest is the generateContentRequest form of a
+// countTokens request, which counts tools and generationConfig too.
+type countedGenerateContentRequest struct {
+	Model string `json:"model"`
+	*GenerateContentRequest
+}
+
+// countFileTokens asks the countTokens endpoint how many tokens a file costs
+// as a single inline part. With cachedContent the file is counted as a prompt
+// that uses the cache, and the response also has the cache's token count.
+func countFileTokens(apiKey, endpoint, modelName, path, cachedContent string, retryInput RetryInput) (*CountTokensResponse, error) {
+	part, err := buildInlineFilePart("@"+path, PartsInput{})
+	if err != nil {
+		return nil, err
+	}
+	contents := []Content{{Parts: []Part{part}}}
+	if cachedContent == "" {
+		return postCountTokens(apiKey, endpoint, map[string][]Content{"contents": contents}, retryInput)
+	}
+	// cachedContent is only accepted inside a generateContentRequest
+	req := &GenerateContentRequest{Contents: contents, CachedContent: cachedContentName(cachedContent)}
+	body := map[string]countedGenerateContentRequest{"generateContentRequest": {Model: modelName, GenerateContentRequest: req}}
+	return postCountTokens(apiKey, endpoint, body, retryInput)
+}
+
+// countStructuredOverhead counts what the response schema and function
+// declarations add to a request. It counts a one-character prompt built the
+// way generate builds requests, with and without them, and returns the
+// difference.
+func countStructuredOverhead(apiKey, endpoint, modelName string, countInput CountTokensInput, retryInput RetryInput) (int, error) {
+	bareConfig := GenerationConfigInput{Temperature: -1, MaxOutputTokens: -1, TopP: -1, TopK: -1, ThinkingBudget: -1}
+	bareTools := ToolsInput{GoogleSearchRetrievalThreshold: -1}
+	genConfig, tools := bareConfig, bareTools
+	if countInput.ResponseSchemaFileOrJSON != "" {
+		genConfig.ResponseMimeType = "application/json"
+		genConfig.ResponseSchemaFileOrJSON = countInput.ResponseSchemaFileOrJSON
+	}
+	tools.FunctionDeclarationsFileOrJSON = countInput.FunctionDeclarationsFileOrJSON
+
+	probe := []ParsedPart{{Type: "text", Value: "."}}
+	var counts [2]int
+	for i, input := range []struct {
+		genConfig GenerationConfigInput
+		tools     ToolsInput
+	}{{bareConfig, bareTools}, {genConfig, tools}} {
+		req, err := buildGenerateContentRequest(nil, probe, PartsInput{}, input.genConfig, input.tools, "", nil)
+		if err != nil {
+			return 0, err
+		}
+		body := map[string]countedGenerateContentRequest{"generateContentRequest": {Model: modelName, GenerateContentRequest: req}}
+		response, err := postCountTokens(apiKey, endpoint, body, retryInput)
+		if err != nil {
+			return 0, err
+		}
+		counts[i] = response.TotalTokens
+	}
+	return counts[1] - counts[0], nil
+}
+
+func postCountTokens(apiKey, endpoint string, body any, retryInput RetryInput) (*CountTokensResponse, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	responseBody, err := postWithRetry(apiKey, endpoint, jsonData, retryInput, nil)
+	if err != nil {
+		return nil, err
+	}
+	var response CountTokensResponse
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse countTokens response: %w", err)
+	}
+	return &response, nil
+}
+
+func handleCountTokens(config *Config, modelName string, args []string, countInput CountTokensInput, retryInput RetryInput) {
+	if !strings.HasPrefix(modelName, "models/") {
+		modelName = "models/" + modelName
+	}
+	endpoint := fmt.Sprintf("/%s:countTokens", modelName)
+
+	paths, err := expandTokenCountPaths(args)
+	if err != nil {
+		fatalf("Error: %v", err)
+	}
+	if len(paths) == 0 {
+		fatalf("Error: no files to count")
+	}
+
+	var pricing ModelPricing
+	if countInput.EstimateCost {
+		var ok bool
+		pricing, ok = lookupPricing(modelName, config.Pricing)
+		if !ok {
+			fatalf("Error: no pricing known for %s (add it under \"pricing\" in config.json)", modelName)
+		}
+	}
+
+	var overhead *int
+	if countInput.ResponseSchemaFileOrJSON != "" || countInput.FunctionDeclarationsFileOrJSON != "" {
+		tokens, err := countStructuredOverhead(config.APIKey, endpoint, modelName, countInput, retryInput)
+		if err != nil {
+			fatalf("Error counting response schema and tool tokens: %v", err)
+		}
+		overhead = &tokens
+	}
+
+	results := make([]fileTokenCount, len(paths))
+	for i := range paths {
+		results[i].Path = paths[i]
+	}
+	next := make(chan int)
+	failedOnce := make(chan struct{})
+	var failOnce sync.Once
+	// The cache is the same for every file, so its count is kept once
+	var cachedTokens *int
+	var cachedOnce sync.Once
+	var wg sync.WaitGroup
+	for w := 0; w < countInput.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				response, err := countFileTokens(config.APIKey, endpoint, modelName, paths[i], countInput.CachedContent, retryInput)
+				if err != nil {
+					results[i].Error = err.Error()
+					failOnce.Do(func() { close(failedOnce) })
+					continue
+				}
+				tokens := response.TotalTokens - response.CachedContentTokenCount
+				results[i].Tokens = tokens
+				if countInput.CachedContent != "" {
+					cachedOnce.Do(func() { cachedTokens = &response.CachedContentTokenCount })
+				}
+				if countInput.EstimateCost {
+					cost := estimateCost(pricing, tokens, 0)
+					results[i].CostUSD = &cost
+				}
+			}
+		}()
+	}
+	dispatched := 0
+dispatch:
+	for dispatched < len(paths) {
+		if countInput.AbortOnFirstError {
+			select {
+			case <-failedOnce:
+				break dispatch
+			case next <- dispatched:
+			}
+		} else {
+			next <- dispatched
+		}
+		dispatched++
+	}
+	close(next)
+	wg.Wait()
+	for i := dispatched; i < len(paths); i++ {
+		results[i].Error = "aborted after an earlier failure"
+	}
+
+	total, failed := 0, 0
+	for _, r := range results {
+		total += r.Tokens
+		if r.Error != "" {
+			failed++
+		}
+	}
+	aborted := len(paths) - dispatched
+	if overhead != nil {
+		total += *overhead
+	}
+
+	if countInput.Format == "json" {
+		out := struct {
+			Model      string           `json:"model"`
+			Files      []fileTokenCount `json:"files"`
+			Structured *int             `json:"schema_and_tools_tokens,omitempty"`
+			Cached     *int             `json:"cached_content_tokens,omitempty"`
+			Total      int              `json:"total_tokens"`
+			CostUSD    *float64         `json:"estimated_cost_usd,omitempty"`
+		}{Model: modelName, Files: results, Structured: overhead, Cached: cachedTokens, Total: total}
+		if countInput.EstimateCost {
+			cost := estimateCost(pricing, total, 0)
+			out.CostUSD = &cost
+		}
+		data, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			fatalf("Error marshalling output: %v", err)
+		}
+		fmt.Println(string(data))
+	} else {
+		writeTokenCountTable(os.Stdout, results, overhead, cachedTokens, total, countInput.EstimateCost, pricing)
+	}
+
+	if aborted > 0 {
+		fatalf("Aborted: %d file(s) counted, %d failed, %d not attempted", len(results)-failed, failed-aborted, aborted)
+	}
+	if failed > 0 {
+		fatalf("%d of %d file(s) could not be counted", failed, len(results))
+	}
+}
+
+func writeTokenCountTable(w io.Writer, results []fileTokenCount, overhead, cached *int, total int, withCost bool, pricing ModelPricing) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := "TOKENS\t"
+	if withCost {
+		header += "COST (USD)\t"
+	}
+	fmt.Fprintln(tw, header+"FILE")
+	for _, r := range results {
+		if r.Error != "" {
+			row := "error\t"
+			if withCost {
+				row += "-\t"
+			}
+			fmt.Fprintf(tw, "%s%s: %s\n", row, r.Path, r.Error)
+			continue
+		}
+		row := fmt.Sprintf("%d\t", r.Tokens)
+		if withCost {
+			row += fmt.Sprintf("%.6f\t", *r.CostUSD)
+		}
+		fmt.Fprintln(tw, row+r.Path)
+	}
+	if overhead != nil {
+		row := fmt.Sprintf("%d\t", *overhead)
+		if withCost {
+			row += fmt.Sprintf("%.6f\t", estimateCost(pricing, *overhead, 0))
+		}
+		fmt.Fprintln(tw, row+"(response schema and tools)")
+	}
+	row := fmt.Sprintf("%d\t", total)
+	if withCost {
+		row += fmt.Sprintf("%.6f\t", estimateCost(pricing, total, 0))
+	}
+	fmt.Fprintln(tw, row+"TOTAL")
+	if cached != nil {
+		// Listed after the total, which counts only the tokens each file adds
+		row := fmt.Sprintf("%d\t", *cached)
+		if withCost {
+			row += "-\t"
+		}
+		fmt.Fprintln(tw, row+"(cached content, per request, not in the total)")
+	}
+	tw.Flush()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// csvOverrideColumns are the optional --parts-from-csv columns that override
+// generation settings for their row. Empty cells keep the flag values.
+var csvOverrideColumns = []string{"temperature", "top_p", "top_k", "max_output_tokens", "system_instruction"}
+
+// applyCSVOverrides returns genConfigInput and systemInstructionStr with the
+// row's override cells applied.
+func applyCSVOverrides(header, row []string, genConfigInput GenerationConfigInput, systemInstructionStr string) (GenerationConfigInput, string, error) {
+	for i, column := range header {
+		value := strings.TrimSpace(row[i])
+		if value == "" || !slices.Contains(csvOverrideColumns, column) {
+			continue
+		}
+		var err error
+		switch column {
+		case "temperature":
+			genConfigInput.Temperature, err = strconv.ParseFloat(value, 64)
+		case "top_p":
+			genConfigInput.TopP, err = strconv.ParseFloat(value, 64)
+		case "top_k":
+			genConfigInput.TopK, err = strconv.Atoi(value)
+		case "max_output_tokens":
+			genConfigInput.MaxOutputTokens, err = strconv.Atoi(value)
+		case "system_instruction":
+			systemInstructionStr = row[i]
+		}
+		if err != nil {
+			return genConfigInput, "", fmt.Errorf("invalid %s '%s'", column, value)
+		}
+	}
+	return genConfigInput, systemInstructionStr, nil
+}
+
+// csvSummary tallies how the rows of a --parts-from-csv run ended.
+type csvSummary struct {
+	Rows          int               `json:"rows"`
+	Failed        int               `json:"failed"`
+	FinishReasons map[string]int    `json:"finish_reasons"`
+	Errors        map[errorKind]int `json:"errors"`
+}
+
+// String formats the tallies as two lines, e.g.
+// "Finish reasons: MAX_TOKENS 2, STOP 40".
+func (s *csvSummary) String() string {
+	reasons := make([]string, 0, len(s.FinishReasons))
+	for reason, n := range s.FinishReasons {
+		reasons = append(reasons, fmt.Sprintf("%s %d", reason, n))
+	}
+	errs := make([]string, 0, len(s.Errors))
+	for kind, n := range s.Errors {
+		errs = append(errs, fmt.Sprintf("%s %d", kind, n))
+	}
+	sort.Strings(reasons)
+	sort.Strings(errs)
+	if len(reasons) == 0 {
+		reasons = []string{"none"}
+	}
+	if len(errs) == 0 {
+		errs = []string{"none"}
+	}
+	return fmt.Sprintf("Finish reasons: %s\nErrors: %s", strings.Join(reasons, ", "), strings.Join(errs, ", "))
+}
+
+// handleCSVGenerate sends one generate request per row of a CSV file, with the
+// row's prompt cell added as a text part after the parts given as arguments.
+// It writes the input rows back out with each answer in the answer column,
+// which is added unless the input already has it. Rows that fail are reported
+// on stderr and left without an answer. A tally of finish reasons and error
+// kinds is printed to stderr at the end.
+func handleCSVGenerate(run *generateRun, parsedParts []ParsedPart, csvInput CSVInput) {
+	inFile, err := os.Open(csvInput.Path)
+	if err != nil {
+		fatalf("Error opening --parts-from-csv file: %v", err)
+	}
+	defer inFile.Close()
+	reader := csv.NewReader(inFile)
+	header, err := reader.Read()
+	if err == io.EOF {
+		fatalf("Error: '%s' has no header row", csvInput.Path)
+	}
+	if err != nil {
+		fatalf("Error reading '%s': %v", csvInput.Path, err)
+	}
+	promptIndex := slices.Index(header, csvInput.PromptColumn)
+	if promptIndex < 0 {
+		fatalf("Error: '%s' has no '%s' column (see --csv-prompt-column)", csvInput.Path, csvInput.PromptColumn)
+	}
+	answerIndex := slices.Index(header, csvInput.AnswerColumn)
+	if answerIndex < 0 {
+		header = append(header, csvInput.AnswerColumn)
+		answerIndex = len(header) - 1
+	}
+
+	// Read once here rather than for every row
+	if err := run.loadParts(parsedParts); err != nil {
+		fatalf("Error reading parts: %v", err)
+	}
+
+	var out io.Writer = os.Stdout
+	if csvInput.OutputPath != "" {
+		outFile, err := os.Create(csvInput.OutputPath)
+		if err != nil {
+			fatalf("Error creating --csv-output file: %v", err)
+		}
+		defer outFile.Close()
+		out = outFile
+	}
+	writer := csv.NewWriter(out)
+	writer.Write(header)
+
+	summary := csvSummary{FinishReasons: map[string]int{}, Errors: map[errorKind]int{}}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatalf("Error reading '%s': %v", csvInput.Path, err)
+		}
+		summary.Rows++
+		for len(row) < len(header) {
+			row = append(row, "")
+		}
+		answer, finishReason, err := generateCSVRow(run, header, row, promptIndex, parsedParts, csvInput)
+		if err != nil {
+			fmt.Fprintf(errorOutput, "Error: row %d: %v\n", summary.Rows, err)
+			summary.Failed++
+			summary.Errors[classifyError(err)]++
+		} else {
+			summary.FinishReasons[finishReason]++
+			if run.outputInput.Verbose {
+				fmt.Fprintf(os.Stderr, "Row %d: %s\n", summary.Rows, finishReason)
+			}
+		}
+		row[answerIndex] = answer
+		// Flushed per row so a long run can be followed, and interrupted,
+		// without losing finished rows.
+		writer.Write(row)
+		writer.Flush()
+	}
+	if err := writer.Error(); err != nil {
+		fatalf("Error writing CSV output: %v", err)
+	}
+
+	fmt.Fprintln(os.Stderr, summary.String())
+	if csvInput.SummaryPath != "" {
+		data, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			fatalf("Error marshalling summary: %v", err)
+		}
+		if err := os.WriteFile(csvInput.SummaryPath, append(data, '\n'), 0644); err != nil {
+			fatalf("Error writing --csv-summary: %v", err)
+		}
+	}
+	run.printSummary()
+	if summary.Failed > 0 {
+		fatalf("%d of %d row(s) failed", summary.Failed, summary.Rows)
+	}
+}
+
+// generateCSVRow builds and sends the request for one --parts-from-csv row and
+// returns the answer text and finish reason.
+func generateCSVRow(run *generateRun, header, row []string, promptIndex int, parsedParts []ParsedPart, csvInput CSVInput) (string, string, error) {
+	if strings.TrimSpace(row[promptIndex]) == "" {
+		return "", "", fmt.Errorf("empty %s", csvInput.PromptColumn)
+	}
+	rowConfig, rowSystemInstruction, err := applyCSVOverrides(header, row, run.genConfigInput, run.systemInstructionStr)
+	if err != nil {
+		return "", "", err
+	}
+	rowParts := append(append([]ParsedPart(nil), parsedParts...), ParsedPart{Type: "text", Value: row[promptIndex]})
+	rowParts = wrapPrompt(rowParts, csvInput.PromptPrefix, csvInput.PromptSuffix)
+
+	requestPayload, err := run.buildRequest(rowSystemInstruction, rowParts, rowConfig)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to build request: %w", err)
+	}
+	response, _, err := run.send(requestPayload)
+	if err != nil {
+		return "", "", err
+	}
+	if run.outputInput.FailIfEmptyText {
+		if err := response.requireText(); err != nil {
+			return "", "", err
+		}
+	}
+	finishReason := "NO_CANDIDATES"
+	if len(response.Candidates) > 0 {
+		finishReason = cmp.Or(response.Candidates[0].FinishReason, "UNSPECIFIED")
+	}
+	answer := response.Text()
+	if run.outputInput.StripMarkdown {
+		answer = stripMarkdown(answer)
+	}
+	return answer, finishReason, nil
+}
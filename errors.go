@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// jsonErrors makes fatal errors print as a JSON object on stderr, with an exit
+// code per error kind, instead of a human-readable line and exit code 1.
+var jsonErrors bool
+
+// errorOutput is the real stderr. Errors are always printed here, while
+// --quiet points os.Stderr, and so every warning, progress line and
+// diagnostic, at the null device. Child processes such as --tool-handler
+// and $EDITOR get errorOutput, so --quiet never hides their own output.
+var errorOutput = os.Stderr
+
+// quiet is set by --quiet.
+var quiet bool
+
+func registerErrorFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&jsonErrors, "json-errors", false, "Print fatal errors as {\"error\": {\"message\", \"kind\", \"httpStatus\"}} on stderr and exit with a code per kind (default: false)")
+	fs.BoolFunc("quiet", "Print only the answer on stdout and errors on stderr; silences warnings, progress, usage reports and --verbose, --trace and similar diagnostics (default: false)", setQuiet)
+	// Flag parsing errors and usage text are errors too
+	fs.SetOutput(errorOutput)
+}
+
+// setQuiet handles --quiet, which is applied as soon as it is parsed so that
+// nothing informational gets out before it takes effect.
+func setQuiet(value string) error {
+	var err error
+	if quiet, err = strconv.ParseBool(value); err != nil {
+		return err
+	}
+	os.Stderr = errorOutput
+	if quiet {
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		os.Stderr = devNull
+	}
+	return nil
+}
+
+// errorKind classifies a fatal error for --json-errors.
+type errorKind string
+
+const (
+	errorKindGeneral errorKind = "error"
+	errorKindUsage   errorKind = "usage"
+	errorKindConfig  errorKind = "config"
+	errorKindAPI     errorKind = "api"
+	errorKindNetwork errorKind = "network"
+)
+
+// exitCodes are only used with --json-errors; otherwise every fatal error
+// exits with 1 as it always has.
+var exitCodes = map[errorKind]int{
+	errorKindGeneral: 1,
+	errorKindUsage:   2,
+	errorKindConfig:  3,
+	errorKindAPI:     4,
+	errorKindNetwork: 5,
+}
+
+// fatalf reports a fatal error and exits. format is the human-readable
+// message, e.g. "Error listing files: %v". The kind is inferred from the first
+// error in args: an *APIError is "api" (with its HTTP status), a failed
+// connection is "network", anything else is "error".
+func fatalf(format string, args ...any) {
+	err := firstError(args)
+	exitWithError(classifyError(err), fmt.Sprintf(format, args...), err)
+}
+
+// configErrorf reports a fatal error loading or saving settings.
+func configErrorf(format string, args ...any) {
+	exitWithError(errorKindConfig, fmt.Sprintf(format, args...), firstError(args))
+}
+
+// usageErrorf reports invalid command-line usage, followed by the command's
+// usage text unless --json-errors is set.
+func usageErrorf(fs *flag.FlagSet, format string, args ...any) {
+	if !jsonErrors {
+		fmt.Fprintf(errorOutput, format+"\n", args...)
+		fs.Usage()
+		os.Exit(1)
+	}
+	exitWithError(errorKindUsage, fmt.Sprintf(format, args...), nil)
+}
+
+// parseFlags parses args with fs, which must use flag.ContinueOnError. A bad
+// flag is reported with usageErrorf, so --json-errors covers it as well, and
+// -h or --help prints the usage text and exits 0.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	// The flag package would print the error and usage itself
+	fs.SetOutput(io.Discard)
+	err := fs.Parse(args)
+	fs.SetOutput(errorOutput)
+	if err == nil {
+		return
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		fs.Usage()
+		os.Exit(0)
+	}
+	// Parsing stops at the bad flag, which may come before --json-errors
+	for _, arg := range args {
+		if name := strings.TrimLeft(arg, "-"); name == "json-errors" || name == "json-errors=true" {
+			jsonErrors = true
+		}
+	}
+	usageErrorf(fs, "Error: %v", err)
+}
+
+func exitWithError(kind errorKind, message string, err error) {
+	if !jsonErrors {
+		fmt.Fprintln(errorOutput, message)
+		os.Exit(1)
+	}
+
+	detail := struct {
+		Message    string    `json:"message"`
+		Kind       errorKind `json:"kind"`
+		HTTPStatus int       `json:"httpStatus,omitempty"`
+	}{Message: trimErrorPrefix(message), Kind: kind}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		detail.HTTPStatus = apiErr.StatusCode
+	}
+	data, _ := json.Marshal(map[string]any{"error": detail})
+	fmt.Fprintln(errorOutput, string(data))
+	os.Exit(exitCodes[kind])
+}
+
+func firstError(args []any) error {
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func classifyError(err error) errorKind {
+	var apiErr *APIError
+	var urlErr *url.Error
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+		return errorKindGeneral
+	case errors.As(err, &apiErr):
+		return errorKindAPI
+	case errors.As(err, &urlErr), errors.As(err, &opErr), isRetryableTransportError(err):
+		return errorKindNetwork
+	}
+	return errorKindGeneral
+}
+
+// trimErrorPrefix drops the leading "Error: " or "Error " of a human-readable
+// message, which the JSON form doesn't need.
+func trimErrorPrefix(message string) string {
+	if rest, ok := strings.CutPrefix(message, "Error: "); ok {
+		return rest
+	}
+	return strings.TrimPrefix(message, "Error ")
+}
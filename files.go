@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File is the Files API resource.
+type File struct {
+	Name           string          `json:"name"`
+	DisplayName    string          `json:"displayName,omitempty"`
+	MIMEType       string          `json:"mimeType,omitempty"`
+	SizeBytes      string          `json:"sizeBytes,omitempty"`
+	CreateTime     string          `json:"createTime,omitempty"`
+	UpdateTime     string          `json:"updateTime,omitempty"`
+	ExpirationTime string          `json:"expirationTime,omitempty"`
+	SHA256Hash     string          `json:"sha256Hash,omitempty"`
+	URI            string          `json:"uri,omitempty"`
+	State          string          `json:"state,omitempty"`
+	Error          json.RawMessage `json:"error,omitempty"`
+}
+
+type uploadFileResponse struct {
+	File File `json:"file"`
+}
+
+// progressReader counts bytes read through it and reports progress to w.
+type progressReader struct {
+	r         io.Reader
+	w         io.Writer
+	total     int64
+	read      int64
+	lastPrint time.Time
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.read += int64(n)
+	if time.Since(p.lastPrint) >= 200*time.Millisecond || p.read == p.total {
+		p.lastPrint = time.Now()
+		percent := 100.0
+		if p.total > 0 {
+			percent = float64(p.read) / float64(p.total) * 100
+		}
+		fmt.Fprintf(p.w, "\rUploading: %d / %d bytes (%.1f%%)", p.read, p.total, percent)
+	}
+	return n, err
+}
+
+// uploadFile performs a resumable upload: a start request that returns an
+// upload URL, followed by a single upload-and-finalize request with the bytes.
+func uploadFile(apiKey, filePath, displayName, mimeType string, showProgress bool, timeout time.Duration) (*File, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file '%s': %w", filePath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file '%s': %w", filePath, err)
+	}
+	size := info.Size()
+
+	if mimeType == "" {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		mimeType = mimeTypeForFile(filePath, head[:n])
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind file '%s': %w", filePath, err)
+		}
+	}
+	if displayName == "" {
+		displayName = filepath.Base(filePath)
+	}
+
+	return uploadReader(apiKey, f, size, displayName, mimeType, showProgress, timeout)
+}
+
+// uploadReader uploads size bytes read from r as a new file. A non-zero
+// timeout bounds the whole upload.
+func uploadReader(apiKey string, r io.Reader, size int64, displayName, mimeType string, showProgress bool, timeout time.Duration) (*File, error) {
+	client, err := getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := contextWithOptionalTimeout(timeout)
+	defer cancel()
+	file, err := uploadReaderContext(ctx, client, apiKey, r, size, displayName, mimeType, showProgress)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("upload timed out after %s (--upload-timeout): %w", timeout, err)
+	}
+	return file, err
+}
+
+func uploadReaderContext(ctx context.Context, client *http.Client, apiKey string, r io.Reader, size int64, displayName, mimeType string, showProgress bool) (*File, error) {
+
+	// Start the resumable session
+	metadata, err := json.Marshal(map[string]interface{}{"file": map[string]string{"display_name": displayName}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal upload metadata: %w", err)
+	}
+	startURL := fmt.Sprintf("%s/files?key=%s", uploadBaseURL(), apiKey)
+	startReq, err := http.NewRequestWithContext(ctx, "POST", startURL, bytes.NewReader(metadata))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload start request: %w", err)
+	}
+	startReq.Header.Set("Content-Type", "application/json")
+	startReq.Header.Set("X-Goog-Upload-Protocol", "resumable")
+	startReq.Header.Set("X-Goog-Upload-Command", "start")
+	startReq.Header.Set("X-Goog-Upload-Header-Content-Length", strconv.FormatInt(size, 10))
+	startReq.Header.Set("X-Goog-Upload-Header-Content-Type", mimeType)
+
+	startReq, finishStartTrace := traceRequest(startReq, "POST /files (upload start)")
+	startResp, err := client.Do(startReq)
+	if err != nil {
+		finishStartTrace(0)
+		return nil, fmt.Errorf("failed to start upload: %w", maskURLErrorKey(err, apiKey))
+	}
+	startBody, _ := io.ReadAll(startResp.Body)
+	startResp.Body.Close()
+	finishStartTrace(startResp.StatusCode)
+	if startResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API error starting upload: %s, Body: %s", startResp.Status, string(startBody))
+	}
+	uploadURL := startResp.Header.Get("X-Goog-Upload-URL")
+	if uploadURL == "" {
+		return nil, fmt.Errorf("upload start response did not include an upload URL")
+	}
+
+	// Send the bytes and finalize
+	body := r
+	if showProgress {
+		body = &progressReader{r: r, w: os.Stderr, total: size}
+	}
+	uploadReq, err := http.NewRequestWithContext(ctx, "POST", uploadURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload request: %w", err)
+	}
+	uploadReq.ContentLength = size
+	uploadReq.Header.Set("X-Goog-Upload-Offset", "0")
+	uploadReq.Header.Set("X-Goog-Upload-Command", "upload, finalize")
+
+	uploadReq, finishUploadTrace := traceRequest(uploadReq, "POST /files (upload bytes)")
+	uploadStatus := 0
+	defer func() { finishUploadTrace(uploadStatus) }()
+	uploadResp, err := client.Do(uploadReq)
+	if showProgress {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file: %w", err)
+	}
+	defer uploadResp.Body.Close()
+	uploadStatus = uploadResp.StatusCode
+
+	responseBody, err := io.ReadAll(uploadResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload response body: %w", err)
+	}
+	if uploadResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API error uploading file: %s, Body: %s", uploadResp.Status, string(responseBody))
+	}
+
+	var result uploadFileResponse
+	if err := json.Unmarshal(responseBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload response: %w. Raw response: %s", err, string(responseBody))
+	}
+	return &result.File, nil
+}
+
+type ListFilesResponse struct {
+	Files         []File `json:"files"`
+	NextPageToken string `json:"nextPageToken,omitempty"`
+}
+
+// fileResourceName normalizes "abc123", "files/abc123" or a full file URI to
+// the "files/abc123" resource name.
+func fileResourceName(ref string) string {
+	if i := strings.LastIndex(ref, "files/"); i >= 0 {
+		return ref[i:]
+	}
+	return "files/" + ref
+}
+
+// isUploadedFileRef reports whether a file part value refers to a file
+// uploaded with the Files API rather than local or remote content.
+func isUploadedFileRef(value string) bool {
+	return strings.HasPrefix(value, "files/") ||
+		strings.HasPrefix(value, apiHost+"/v1beta/files/") || strings.HasPrefix(value, apiHost+"/v1/files/")
+}
+
+func getFile(apiKey, name string) (*File, error) {
+	var file File
+	if err := makeAPIRequest(apiKey, "GET", "/"+fileResourceName(name), nil, &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func listFiles(apiKey string) ([]File, error) {
+	var files []File
+	pageToken := ""
+	for {
+		endpoint := "/files?pageSize=100"
+		if pageToken != "" {
+			endpoint += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		var response ListFilesResponse
+		if err := makeAPIRequest(apiKey, "GET", endpoint, nil, &response); err != nil {
+			return nil, err
+		}
+		files = append(files, response.Files...)
+		if response.NextPageToken == "" {
+			return files, nil
+		}
+		pageToken = response.NextPageToken
+	}
+}
+
+func deleteFile(apiKey, name string) error {
+	var empty struct{}
+	return makeAPIRequest(apiKey, "DELETE", "/"+fileResourceName(name), nil, &empty)
+}
+
+// waitForFileActive polls the file until it leaves the PROCESSING state,
+// doubling the delay between polls up to a cap.
+func waitForFileActive(apiKey, name string, timeout time.Duration) (*File, error) {
+	deadline := time.Now().Add(timeout)
+	delay := 500 * time.Millisecond
+	announced := false
+	for {
+		file, err := getFile(apiKey, name)
+		if err != nil {
+			return nil, err
+		}
+		switch file.State {
+		case "ACTIVE", "": // Files without a state are usable as-is
+			return file, nil
+		case "FAILED":
+			return nil, fmt.Errorf("file %s failed processing: %s", file.Name, string(file.Error))
+		}
+		if !announced {
+			fmt.Fprintf(os.Stderr, "Waiting for %s to become ACTIVE (state: %s)...\n", file.Name, file.State)
+			announced = true
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("timed out after %s waiting for file %s to become ACTIVE (state: %s)", timeout, file.Name, file.State)
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > 10*time.Second {
+			delay = 10 * time.Second
+		}
+	}
+}
+
+// resolveFileReferences looks up every file part that names an uploaded file,
+// waits for it to become ACTIVE and fills in its URI and MIME type.
+func resolveFileReferences(apiKey string, parts []ParsedPart, timeout time.Duration) error {
+	for i := range parts {
+		if parts[i].Type != "file" || !isUploadedFileRef(parts[i].Value) {
+			continue
+		}
+		file, err := waitForFileActive(apiKey, parts[i].Value, timeout)
+		if err != nil {
+			return fmt.Errorf("failed to resolve file '%s': %w", parts[i].Value, err)
+		}
+		parts[i].FileURI = file.URI
+		parts[i].MIMEType = file.MIMEType
+	}
+	return nil
+}
+
+// Total request size limit for inline data; larger payloads must use the Files API.
+const maxInlineRequestBytes = 20 * 1024 * 1024
+
+// inlineParts returns the inline data parts of the system instruction and the
+// contents, in request order.
+func inlineParts(req *GenerateContentRequest) []*Part {
+	var inline []*Part
+	if req.SystemInstruction != nil {
+		for i := range req.SystemInstruction.Parts {
+			if req.SystemInstruction.Parts[i].InlineData != nil {
+				inline = append(inline, &req.SystemInstruction.Parts[i])
+			}
+		}
+	}
+	for ci := range req.Contents {
+		for pi := range req.Contents[ci].Parts {
+			if req.Contents[ci].Parts[pi].InlineData != nil {
+				inline = append(inline, &req.Contents[ci].Parts[pi])
+			}
+		}
+	}
+	return inline
+}
+
+func inlineDataSize(req *GenerateContentRequest) int {
+	total := 0
+	for _, p := range inlineParts(req) {
+		total += len(p.InlineData.Data)
+	}
+	return total
+}
+
+// enforceInlineLimit checks the cumulative base64 size of inline parts. Over the
+// limit it either fails or, with autoFileAPI, uploads the largest inline parts
+// to the Files API and references them instead until the request fits.
+func enforceInlineLimit(apiKey string, req *GenerateContentRequest, filesInput FilesInput, verbose bool) error {
+	total := inlineDataSize(req)
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Inline data: %d bytes (base64), limit %d bytes\n", total, maxInlineRequestBytes)
+	}
+	if total <= maxInlineRequestBytes {
+		return nil
+	}
+	if !filesInput.AutoFileAPI {
+		return fmt.Errorf("inline data totals %d bytes (base64), over the %d byte request limit. Upload large files with upload-file or pass --auto-file-api", total, maxInlineRequestBytes)
+	}
+
+	inline := inlineParts(req)
+	sort.Slice(inline, func(i, j int) bool {
+		return len(inline[i].InlineData.Data) > len(inline[j].InlineData.Data)
+	})
+
+	for i, part := range inline {
+		if total <= maxInlineRequestBytes {
+			break
+		}
+		encodedSize := len(part.InlineData.Data)
+		data, err := base64.StdEncoding.DecodeString(part.InlineData.Data)
+		if err != nil {
+			return fmt.Errorf("failed to decode inline part for upload: %w", err)
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Moving inline part (%s, %d bytes) to the Files API\n", part.InlineData.MIMEType, len(data))
+		}
+		if err := moveToFileAPI(apiKey, part, data, fmt.Sprintf("gemini-cli-part-%d", i+1), filesInput); err != nil {
+			return err
+		}
+		total -= encodedSize
+	}
+	return nil
+}
+
+// applyInlineThreshold uploads every inline part whose decoded size is over
+// filesInput.InlineThreshold bytes to the Files API, leaving smaller parts
+// inline.
+func applyInlineThreshold(apiKey string, req *GenerateContentRequest, filesInput FilesInput, verbose bool) error {
+	n := 0
+	for ci := range req.Contents {
+		for pi := range req.Contents[ci].Parts {
+			part := &req.Contents[ci].Parts[pi]
+			if part.InlineData == nil {
+				continue
+			}
+			n++
+			encoded := part.InlineData.Data
+			size := int64(len(encoded)/4*3 - (len(encoded) - len(strings.TrimRight(encoded, "="))))
+			if size <= filesInput.InlineThreshold {
+				if verbose {
+					fmt.Fprintf(os.Stderr, "File part %d (%s, %d bytes): inline\n", n, part.InlineData.MIMEType, size)
+				}
+				continue
+			}
+			if verbose {
+				fmt.Fprintf(os.Stderr, "File part %d (%s, %d bytes): Files API, over --inline-threshold\n", n, part.InlineData.MIMEType, size)
+			}
+			data, err := base64.StdEncoding.DecodeString(part.InlineData.Data)
+			if err != nil {
+				return fmt.Errorf("failed to decode inline part for upload: %w", err)
+			}
+			if err := moveToFileAPI(apiKey, part, data, fmt.Sprintf("gemini-cli-part-%d", n), filesInput); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// uploadedParts remembers, by MIME type and content, the parts moved to the
+// Files API during this run, so a file part sent in many requests
+// (--split-chunks, --parts-from-csv, several prompts) is uploaded once.
+var (
+	uploadedPartsMu sync.Mutex
+	uploadedParts   = map[[sha256.Size]byte]FileDataPart{}
+)
+
+// moveToFileAPI uploads data and rewrites part to reference the uploaded file
+// instead of carrying it inline.
+func moveToFileAPI(apiKey string, part *Part, data []byte, displayName string, filesInput FilesInput) error {
+	uploadedPartsMu.Lock()
+	defer uploadedPartsMu.Unlock()
+	key := sha256.Sum256(append([]byte(part.InlineData.MIMEType+"\x00"), data...))
+	if fileData, ok := uploadedParts[key]; ok {
+		part.FileData = &fileData
+		part.InlineData = nil
+		return nil
+	}
+
+	file, err := uploadReader(apiKey, bytes.NewReader(data), int64(len(data)), displayName, part.InlineData.MIMEType, false, filesInput.UploadTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to upload inline part: %w", err)
+	}
+	file, err = waitForFileActive(apiKey, file.Name, filesInput.WaitTimeout)
+	if err != nil {
+		return err
+	}
+	fileData := FileDataPart{MIMEType: file.MIMEType, FileURI: file.URI}
+	uploadedParts[key] = fileData
+	part.FileData = &fileData
+	part.InlineData = nil
+	return nil
+}
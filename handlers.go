@@ -2,57 +2,334 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
+	"time"
 )
 
-func handleSetConfig(apiKey string) {
-	err := saveAPIKey(apiKey)
+// mergeSystemInstructions layers the per-call system instruction after the
+// base one stored in config; each becomes its own text part. With replace,
+// only the per-call instruction is used.
+func mergeSystemInstructions(base, cli string, replace bool) []string {
+	var merged []string
+	if base != "" && !replace {
+		merged = append(merged, base)
+	}
+	if cli != "" {
+		merged = append(merged, cli)
+	}
+	return merged
+}
+
+// compactSystemInstructions applies compactWhitespace to each system
+// instruction text, reporting the estimated savings with verbose.
+func compactSystemInstructions(instructions []string, level string, verbose bool) []string {
+	before, after := 0, 0
+	compacted := make([]string, len(instructions))
+	for i, text := range instructions {
+		compacted[i] = compactWhitespace(text, level)
+		before += len([]rune(text))
+		after += len([]rune(compacted[i]))
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Compacted system instruction: %d -> %d characters, about %d tokens saved\n", before, after, (before-after)/charsPerToken)
+	}
+	return compacted
+}
+
+func handleSetConfig(apiKey, keyPoolStr, safetySettingsStr, systemInstruction, outputFormat string) {
+	if apiKey != "" {
+		err := saveAPIKey(apiKey)
+		if err != nil {
+			configErrorf("Error saving API key: %v", err)
+		}
+	}
+	if keyPoolStr != "" {
+		keys, err := parseKeyPool(keyPoolStr)
+		if err != nil {
+			fatalf("Error parsing key pool: %v", err)
+		}
+		if err := saveAPIKeyPool(keys); err != nil {
+			configErrorf("Error saving key pool: %v", err)
+		}
+	}
+	if safetySettingsStr != "" {
+		settings, err := parseSafetySettings(safetySettingsStr)
+		if err != nil {
+			fatalf("Error parsing safety settings: %v", err)
+		}
+		if err := saveSafetySettings(settings); err != nil {
+			configErrorf("Error saving safety settings: %v", err)
+		}
+	}
+	if systemInstruction != "" {
+		if err := saveSystemInstruction(systemInstruction); err != nil {
+			configErrorf("Error saving system instruction: %v", err)
+		}
+	}
+	if outputFormat != "" {
+		if err := saveDefaultOutputFormat(outputFormat); err != nil {
+			configErrorf("Error saving default output format: %v", err)
+		}
+	}
+}
+
+func handleGenerateContent(run *generateRun, parsedParts []ParsedPart) {
+	if err := resolveFileReferences(run.config.APIKey, parsedParts, run.filesInput.WaitTimeout); err != nil {
+		fatalf("Error resolving uploaded files: %v", err)
+	}
+
+	requestPayload, err := run.buildRequest(run.systemInstructionStr, parsedParts, run.genConfigInput)
+	if err != nil {
+		fatalf("Error building request: %v", err)
+	}
+
+	if run.outputInput.PrettyParts {
+		fmt.Print(formatRequestPreview(run.modelName, requestPayload, previewFileNames(parsedParts)))
+		return
+	}
+
+	if run.outputInput.SaveRequestOnly {
+		// Saved fixtures keep their parts inline
+		if err := enforceInlineLimit(run.config.APIKey, requestPayload, run.filesInput, run.outputInput.Verbose); err != nil {
+			fatalf("Error: %v", err)
+		}
+		fixturePath, err := saveRequestFixture(requestPayload, run.outputInput.FixtureDir, run.outputInput.FixtureName)
+		if err != nil {
+			fatalf("Error saving request fixture: %v", err)
+		}
+		fmt.Printf("Request saved to %s\n", fixturePath)
+		return
+	}
+
+	// Taken before sending, so tool turns don't end up in it
+	var prompt Content
+	if len(requestPayload.Contents) > 0 {
+		prompt = requestPayload.Contents[len(requestPayload.Contents)-1]
+	}
+	outputInput := run.outputInput
+
+	// Echoed before sending, so the prompt is shown even if the request fails
+	if outputInput.EchoPrompt {
+		fmt.Println(formatPromptEcho(requestPayload.SystemInstruction, prompt))
+	}
+
+	response, responseBody, err := run.send(requestPayload)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error saving API key: %v\n", err)
-		os.Exit(1)
+		fatalf("Error: %v", err)
+	}
+
+	if outputInput.FailIfEmptyText {
+		if err := response.requireText(); err != nil {
+			fatalf("Error: %v", err)
+		}
+	}
+
+	switch {
+	case outputInput.Template != nil:
+		if err := renderOutputTemplate(os.Stdout, outputInput.Template, run.modelName, response); err != nil {
+			fatalf("Error: %v", err)
+		}
+	case outputInput.Format == "base64":
+		if err := writeInlineDataBase64(os.Stdout, response); err != nil {
+			fatalf("Error: %v", err)
+		}
+	case outputInput.Format == "csv":
+		if err := writeCSV(os.Stdout, response.Text()); err != nil {
+			fatalf("Error writing CSV output: %v", err)
+		}
+	case outputInput.Format == "text":
+		if outputInput.StripMarkdown {
+			fmt.Println(stripMarkdown(response.Text()))
+		} else {
+			fmt.Println(response.Text())
+		}
+	case outputInput.Format == "json-answer":
+		text := response.Text()
+		if outputInput.ExtractJSON {
+			if text, err = extractJSON(text); err != nil {
+				fatalf("Error: %v", err)
+			}
+		}
+		answer, err := formatJSONAnswer(text, outputInput.Minify)
+		if err != nil {
+			fatalf("Error: %v", err)
+		}
+		fmt.Println(answer)
+	default:
+		if outputInput.Minify {
+			responseBody = minifyJSON(responseBody)
+		}
+		fmt.Println(string(responseBody))
+	}
+
+	if len(prompt.Parts) > 0 && len(response.Candidates) > 0 {
+		if err := saveLastExchange(run.modelName, prompt, response.modelTurn()); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+	if warning := thinkingCostWarning(response.UsageMetadata, outputInput.ThinkingWarnRatio); warning != "" {
+		fmt.Fprintln(os.Stderr, warning)
 	}
+	if outputInput.ShowSafety {
+		fmt.Fprintln(os.Stderr, formatSafetyRatings(response.Candidates))
+	}
+	if outputInput.DetailedUsage {
+		fmt.Fprintln(os.Stderr, formatUsage(response.UsageMetadata))
+	}
+	run.printSummary()
 }
 
-func handleGenerateContent(
-	apiKey,
-	modelName,
-	systemInstructionStr string,
-	parsedParts []ParsedPart,
-	genConfigInput GenerationConfigInput,
-	toolsInput ToolsInput,
-	safetySettingsStr string) {
+// postWithRetry POSTs jsonData to endpoint, retrying per retryInput and
+// sharing the --target-rpm throttle with other processes. A non-zero
+// retryInput.Timeout bounds all attempts together, including the waits
+// between them.
+func postWithRetry(apiKey, endpoint string, jsonData []byte, retryInput RetryInput, stats *retryStats) ([]byte, error) {
+	ctx, cancel := contextWithOptionalTimeout(retryInput.Timeout)
+	defer cancel()
+	var responseBody []byte
+	err := doWithRetry(ctx, retryInput, stats, func() error {
+		if retryInput.TargetRPM > 0 {
+			if err := acquireThrottle(ctx, retryInput.TargetRPM); err != nil {
+				return fmt.Errorf("failed waiting for throttle: %w", err)
+			}
+		}
+		var err error
+		responseBody, err = doAPIRequestContext(ctx, apiKey, "POST", endpoint, bytes.NewReader(jsonData))
+		var apiErr *APIError
+		if retryInput.TargetRPM > 0 && errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests && apiErr.RetryAfter > 0 {
+			if err := throttleBackoff(apiErr.RetryAfter); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to update throttle: %v\n", err)
+			}
+		}
+		return err
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("request timed out after %s (--generate-timeout): %w", retryInput.Timeout, err)
+	}
+	return responseBody, err
+}
 
-	if !strings.HasPrefix(modelName, "models/") {
-		modelName = "models/" + modelName
+func handleUploadFile(apiKey, filePath, displayName, mimeType string, quiet bool, timeout time.Duration) {
+	showProgress := !quiet && isTerminal(os.Stderr)
+	file, err := uploadFile(apiKey, filePath, displayName, mimeType, showProgress, timeout)
+	if err != nil {
+		fatalf("Error uploading file: %v", err)
 	}
 
-	requestPayload, err := buildGenerateContentRequest(systemInstructionStr, parsedParts, genConfigInput, toolsInput, safetySettingsStr)
+	outputData, err := json.MarshalIndent(file, "", "  ")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error building request: %v\n", err)
-		os.Exit(1)
+		fatalf("Error marshalling uploaded file info: %v", err)
 	}
+	fmt.Println(string(outputData))
+}
 
-	if len(requestPayload.Contents) == 0 && requestPayload.SystemInstruction == nil {
-		fmt.Fprintln(os.Stderr, "Error: Request must contain 'contents' or 'system_instruction'.")
-		os.Exit(1)
+func handleListFiles(apiKey string) {
+	files, err := listFiles(apiKey)
+	if err != nil {
+		fatalf("Error listing files: %v", err)
+	}
+	if files == nil {
+		files = []File{}
 	}
 
-	jsonData, err := json.Marshal(requestPayload)
+	outputData, err := json.MarshalIndent(map[string][]File{"files": files}, "", "  ")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error marshalling request to JSON: %v\n", err)
-		os.Exit(1)
+		fatalf("Error marshalling file list: %v", err)
 	}
+	fmt.Println(string(outputData))
+}
 
-	endpoint := fmt.Sprintf("/%s:generateContent", modelName)
+func handleGetFile(apiKey, name string) {
+	file, err := getFile(apiKey, name)
+	if err != nil {
+		fatalf("Error getting file: %v", err)
+	}
 
-	err = makeAPIRequest(apiKey, "POST", endpoint, bytes.NewBuffer(jsonData), nil) // Target is nil to print raw JSON
+	outputData, err := json.MarshalIndent(file, "", "  ")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error making API request: %v\n", err)
-		os.Exit(1)
+		fatalf("Error marshalling file info: %v", err)
 	}
+	fmt.Println(string(outputData))
+}
+
+func handleDeleteFile(apiKey, name string) {
+	if err := confirm("delete " + fileResourceName(name)); err != nil {
+		fatalf("Error: %v", err)
+	}
+	if err := deleteFile(apiKey, name); err != nil {
+		fatalf("Error deleting file: %v", err)
+	}
+	fmt.Printf("Deleted %s\n", fileResourceName(name))
+}
+
+func handleCreateCache(apiKey, modelName, systemInstruction, displayName string, ttl time.Duration) {
+	cache, err := createCachedContent(apiKey, modelName, systemInstruction, displayName, ttl)
+	if err != nil {
+		fatalf("Error creating cache: %v", err)
+	}
+
+	outputData, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		fatalf("Error marshalling cache info: %v", err)
+	}
+	fmt.Println(string(outputData))
+	fmt.Fprintf(os.Stderr, "Use it with: generate --model %s --cached-content %s ...\n", strings.TrimPrefix(cache.Model, "models/"), cache.Name)
+}
+
+func handleUpdateCache(apiKey, name string, ttl time.Duration) {
+	cache, err := updateCachedContentTTL(apiKey, name, ttl)
+	if err != nil {
+		fatalf("Error updating cache: %v", err)
+	}
+
+	outputData, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		fatalf("Error marshalling cache info: %v", err)
+	}
+	fmt.Println(string(outputData))
+}
+
+func handleListSafetyOptions() {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CATEGORY\tDESCRIPTION")
+	for _, c := range safetyCategories {
+		fmt.Fprintf(tw, "%s\t%s\n", c.Name, c.Description)
+	}
+	fmt.Fprintln(tw, "")
+	fmt.Fprintln(tw, "THRESHOLD\tDESCRIPTION")
+	for _, t := range safetyThresholds {
+		fmt.Fprintf(tw, "%s\t%s\n", t.Name, t.Description)
+	}
+	tw.Flush()
+}
+
+// sortModels stably sorts by name, display-name, input-limit or output-limit.
+func sortModels(models []ModelOutputInfo, key string, reverse bool) {
+	var less func(a, b ModelOutputInfo) bool
+	switch key {
+	case "display-name":
+		less = func(a, b ModelOutputInfo) bool { return a.DisplayName < b.DisplayName }
+	case "input-limit":
+		less = func(a, b ModelOutputInfo) bool { return a.InputTokenLimit < b.InputTokenLimit }
+	case "output-limit":
+		less = func(a, b ModelOutputInfo) bool { return a.OutputTokenLimit < b.OutputTokenLimit }
+	default:
+		less = func(a, b ModelOutputInfo) bool { return a.Name < b.Name }
+	}
+	sort.SliceStable(models, func(i, j int) bool {
+		if reverse {
+			return less(models[j], models[i])
+		}
+		return less(models[i], models[j])
+	})
 }
 
 type ModelOutputInfo struct {
@@ -65,17 +342,14 @@ type ModelOutputInfo struct {
 	SupportedForTextOutput     string   `json:"supportedForTextOutput"` // Added by CLI
 }
 
-func handleListModels(apiKey string) {
-	var response ListModelsResponse
-	// Pass target to unmarshal, makeAPIRequest will not print raw JSON if target is provided
-	err := makeAPIRequest(apiKey, "GET", "/models", nil, &response)
+func handleListModels(apiKey string, listInput ListModelsInput) {
+	models, err := listModels(apiKey)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error listing models: %v\n", err)
-		os.Exit(1)
+		fatalf("Error listing models: %v", err)
 	}
 
 	var processedModels []ModelOutputInfo
-	for _, m := range response.Models {
+	for _, m := range models {
 		isTextSupported := "No"
 		supportsGenContent := false
 		for _, method := range m.SupportedGenerationMethods {
@@ -100,6 +374,10 @@ func handleListModels(apiKey string) {
 			}
 		}
 
+		if listInput.OnlyText && isTextSupported != "Yes" {
+			continue
+		}
+
 		processedModels = append(processedModels, ModelOutputInfo{
 			Name:                       m.Name,
 			DisplayName:                m.DisplayName,
@@ -111,10 +389,22 @@ func handleListModels(apiKey string) {
 		})
 	}
 
+	sortModels(processedModels, listInput.Sort, listInput.Reverse)
+
+	if listInput.Short {
+		for _, m := range processedModels {
+			fmt.Printf("%s — %d/%d tokens\n", strings.TrimPrefix(m.Name, "models/"), m.InputTokenLimit, m.OutputTokenLimit)
+		}
+		return
+	}
+	if listInput.Format == "table" {
+		writeModelTable(os.Stdout, processedModels, terminalWidth())
+		return
+	}
+
 	outputData, err := json.MarshalIndent(map[string][]ModelOutputInfo{"models": processedModels}, "", "  ")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error marshalling processed model list: %v\n", err)
-		os.Exit(1)
+		fatalf("Error marshalling processed model list: %v", err)
 	}
 	fmt.Println(string(outputData))
 }
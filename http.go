@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	httpClientOnce sync.Once
+	httpClient     *http.Client
+	httpClientErr  error
+)
+
+// getHTTPClient returns the client shared by all requests, built on first use
+// from the TLS flags of the running command.
+func getHTTPClient() (*http.Client, error) {
+	httpClientOnce.Do(func() {
+		httpClient, httpClientErr = newHTTPClient(tlsInput)
+	})
+	return httpClient, httpClientErr
+}
+
+// maxIdleConnsPerHost keeps enough idle connections to the API host for
+// concurrent requests (benchmark, parallel uploads) to reuse them instead of
+// opening a new TLS connection each time. net/http's default is 2.
+const maxIdleConnsPerHost = 16
+
+func newHTTPClient(input TLSInput) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	if input.CACertPath == "" && !input.InsecureSkipVerify {
+		return &http.Client{Transport: transport}, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if input.CACertPath != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(input.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate '%s': %w", input.CACertPath, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in '%s'", input.CACertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if input.InsecureSkipVerify {
+		fmt.Fprintln(os.Stderr, "WARNING: TLS certificate verification is DISABLED (--insecure-skip-verify). Your API key and data can be intercepted.")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// errFetchRefused is returned for redirects and addresses the fetch flags do
+// not allow. It is not worth retrying.
+var errFetchRefused = errors.New("fetch refused")
+
+// getFetchClient returns a client for downloading URL file parts. It shares
+// the TLS settings of getHTTPClient and applies the redirect policy from the
+// fetch flags.
+func getFetchClient() (*http.Client, error) {
+	base, err := getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	client := *base
+	if fetchInput.BlockPrivateIPs {
+		transport := base.Transport.(*http.Transport).Clone()
+		// A proxy would make the dial target the proxy, not the file host.
+		transport.Proxy = nil
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refusePrivateAddress}
+		transport.DialContext = dialer.DialContext
+		client.Transport = transport
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > fetchInput.MaxRedirects {
+			return fmt.Errorf("%w: stopped after %d redirects (--max-redirects)", errFetchRefused, fetchInput.MaxRedirects)
+		}
+		if fetchInput.SameHostRedirects && req.URL.Host != via[0].URL.Host {
+			return fmt.Errorf("%w: %s to %s leaves the original host (--same-host-redirects)", errFetchRefused, via[0].URL.Host, req.URL.Host)
+		}
+		return nil
+	}
+	return &client, nil
+}
+
+// cgnatRange is the shared address space (RFC 6598), not covered by
+// net.IP.IsPrivate.
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// refusePrivateAddress is a net.Dialer Control hook that rejects loopback,
+// private, link-local and unspecified addresses. Checking at dial time covers
+// every resolved address and every redirect hop.
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("refusing to connect to unparsable address %s", address)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() || cgnatRange.Contains(ip) {
+		return fmt.Errorf("%w: %s is a private address (--block-private-ips)", errFetchRefused, ip)
+	}
+	return nil
+}
+
+// traceRequests prints connection and response timings for every API request
+// (--trace).
+var traceRequests bool
+
+// requestTrace collects the httptrace events of one request.
+type requestTrace struct {
+	mu        sync.Mutex
+	label     string
+	start     time.Time
+	dns       time.Duration // -1 when no lookup was made, e.g. for an IP host
+	connect   time.Duration // -1 when no connection was dialled
+	tls       time.Duration
+	reused    bool
+	wrote     time.Time
+	firstByte time.Time
+}
+
+// traceRequest attaches an httptrace to req when --trace is set. Call the
+// returned function with the response status (0 if there was none) once the
+// body has been read; it prints the timings to stderr.
+func traceRequest(req *http.Request, label string) (*http.Request, func(status int)) {
+	if !traceRequests {
+		return req, func(int) {}
+	}
+	t := &requestTrace{label: label, start: time.Now(), dns: -1, connect: -1}
+	var dnsStart, connectStart, tlsStart time.Time
+	clientTrace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.mu.Lock(); dnsStart = time.Now(); t.mu.Unlock() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.mu.Lock(); t.dns = time.Since(dnsStart); t.mu.Unlock() },
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			if connectStart.IsZero() {
+				connectStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone:          func(string, string, error) { t.mu.Lock(); t.connect = time.Since(connectStart); t.mu.Unlock() },
+		TLSHandshakeStart:    func() { t.mu.Lock(); tlsStart = time.Now(); t.mu.Unlock() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.mu.Lock(); t.tls = time.Since(tlsStart); t.mu.Unlock() },
+		GotConn:              func(info httptrace.GotConnInfo) { t.mu.Lock(); t.reused = info.Reused; t.mu.Unlock() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mu.Lock(); t.wrote = time.Now(); t.mu.Unlock() },
+		GotFirstResponseByte: func() { t.mu.Lock(); t.firstByte = time.Now(); t.mu.Unlock() },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), clientTrace))
+	return req, func(status int) {
+		fmt.Fprintln(os.Stderr, t.report(status, time.Since(t.start)))
+	}
+}
+
+// report formats the timings, e.g. "Trace: POST /models/m:generateContent
+// -> 200: DNS 3ms, connect 12ms, TLS 25ms, sent 41ms, first byte 2.1s
+// (server 2.06s), total 2.2s".
+func (t *requestTrace) report(status int, total time.Duration) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := func(d time.Duration) string { return d.Round(time.Millisecond).String() }
+	var parts []string
+	if t.reused {
+		parts = append(parts, "reused connection")
+	} else {
+		if t.dns >= 0 {
+			parts = append(parts, "DNS "+ms(t.dns))
+		}
+		if t.connect >= 0 {
+			parts = append(parts, "connect "+ms(t.connect))
+		}
+		if t.tls > 0 {
+			parts = append(parts, "TLS "+ms(t.tls))
+		}
+	}
+	if !t.wrote.IsZero() {
+		parts = append(parts, "sent "+ms(t.wrote.Sub(t.start)))
+	}
+	if !t.firstByte.IsZero() {
+		firstByte := "first byte " + ms(t.firstByte.Sub(t.start))
+		if !t.wrote.IsZero() {
+			firstByte += " (server " + ms(t.firstByte.Sub(t.wrote)) + ")"
+		}
+		parts = append(parts, firstByte)
+	}
+	parts = append(parts, "total "+ms(total))
+	result := "failed"
+	if status != 0 {
+		result = strconv.Itoa(status)
+	}
+	return fmt.Sprintf("Trace: %s -> %s: %s", t.label, result, strings.Join(parts, ", "))
+}
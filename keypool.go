@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Key rotation modes for --key-rotation.
+const (
+	keyRotationRoundRobin = "round-robin"
+	keyRotationFailover   = "failover"
+)
+
+// keyRotation spreads API requests over the keys of the key pool (--key-rotation).
+// Empty means every request uses the single API key.
+var keyRotation string
+
+func registerKeyRotationFlags(fs *flag.FlagSet) {
+	fs.Func("key-rotation", "Spread requests over the keys saved with set-config --key-pool or given in "+envAPIKeyPool+": round-robin uses the next key for each request, failover stays on one key until it is rate limited. Either way a 429 moves on to the next key. (default: off)", func(value string) error {
+		if value != keyRotationRoundRobin && value != keyRotationFailover {
+			return fmt.Errorf("must be %s or %s", keyRotationRoundRobin, keyRotationFailover)
+		}
+		keyRotation = value
+		return nil
+	})
+}
+
+// parseKeyPool splits a comma-separated list of API keys. Repeated keys are
+// dropped: the pool tracks quota per key, so a duplicate would only be tried
+// twice in a row.
+func parseKeyPool(value string) ([]string, error) {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("empty key in the list")
+		}
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// apiKeyPool hands out keys for --key-rotation and remembers which ones hit
+// their quota during this run.
+type apiKeyPool struct {
+	mu        sync.Mutex
+	keys      []string
+	next      int
+	exhausted map[string]bool
+}
+
+// pick returns the key for the next request: the next key that isn't
+// exhausted, starting from the current one. Once every key is exhausted they
+// are all tried again, since by then the caller has backed off.
+func (p *apiKeyPool) pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.exhausted) == len(p.keys) {
+		clear(p.exhausted)
+	}
+	for p.exhausted[p.keys[p.next]] {
+		p.next = (p.next + 1) % len(p.keys)
+	}
+	key := p.keys[p.next]
+	if keyRotation == keyRotationRoundRobin {
+		p.next = (p.next + 1) % len(p.keys)
+	}
+	return key
+}
+
+// exhaust marks key as out of quota and reports whether another key is left
+// to try.
+func (p *apiKeyPool) exhaust(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exhausted[key] = true
+	return len(p.exhausted) < len(p.keys)
+}
+
+var (
+	keyPoolOnce sync.Once
+	keyPool     *apiKeyPool
+	keyPoolErr  error
+)
+
+// activeKeyPool loads the key pool the first time it is needed.
+func activeKeyPool() (*apiKeyPool, error) {
+	keyPoolOnce.Do(func() {
+		config, err := resolveConfig()
+		if err != nil {
+			keyPoolErr = err
+			return
+		}
+		if len(config.APIKeyPool) == 0 {
+			keyPoolErr = fmt.Errorf("--key-rotation needs a key pool; run 'set-config --key-pool KEY1,KEY2' or set %s", envAPIKeyPool)
+			return
+		}
+		// Deduplicated again here, since the config file may be edited by hand
+		keys, err := parseKeyPool(strings.Join(config.APIKeyPool, ","))
+		if err != nil {
+			keyPoolErr = fmt.Errorf("invalid key pool: %w", err)
+			return
+		}
+		keyPool = &apiKeyPool{keys: keys, exhausted: map[string]bool{}}
+	})
+	return keyPool, keyPoolErr
+}
+
+// doPooledAPIRequest sends the request with a key from the pool, moving on to
+// the next key while the API answers 429. When every key is rate limited the
+// last 429 is returned, so the caller's retry and backoff apply as usual.
+func doPooledAPIRequest(ctx context.Context, method, endpointURL string, body io.Reader) ([]byte, error) {
+	pool, err := activeKeyPool()
+	if err != nil {
+		return nil, err
+	}
+	// Read once so the body can be sent again with another key
+	var data []byte
+	if body != nil {
+		if data, err = io.ReadAll(body); err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+	}
+	for {
+		key := pool.pick()
+		var attemptBody io.Reader
+		if body != nil {
+			attemptBody = bytes.NewReader(data)
+		}
+		responseBody, err := sendAPIRequest(ctx, key, method, endpointURL, attemptBody)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests && pool.exhaust(key) {
+			fmt.Fprintf(os.Stderr, "Key %s is rate limited, switching to the next key (--key-rotation)\n", maskAPIKey(key))
+			continue
+		}
+		return responseBody, err
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lastExchange is the most recent generate prompt and answer, kept in the
+// config directory so --continue-last can send them as the previous turns of
+// a follow-up. Only one exchange is kept.
+type lastExchange struct {
+	Model   string    `json:"model"`
+	SavedAt time.Time `json:"saved_at"`
+	Prompt  Content   `json:"prompt"`
+	Answer  Content   `json:"answer"`
+}
+
+func lastExchangePath() (string, error) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(configPath), "last-exchange.json"), nil
+}
+
+// saveLastExchange replaces the saved exchange. It does nothing with
+// --no-store.
+func saveLastExchange(modelName string, prompt, answer Content) error {
+	if noStore {
+		return nil
+	}
+	path, err := lastExchangePath()
+	if err != nil {
+		return err
+	}
+	if err := ensureConfigDir(path); err != nil {
+		return err
+	}
+	prompt.Role, answer.Role = "user", "model"
+	data, err := json.Marshal(lastExchange{Model: modelName, SavedAt: time.Now().UTC(), Prompt: prompt, Answer: answer})
+	if err != nil {
+		return fmt.Errorf("failed to marshal last exchange: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save last exchange: %w", err)
+	}
+	return nil
+}
+
+func loadLastExchange() (*lastExchange, error) {
+	path, err := lastExchangePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no previous exchange saved yet; run generate without --continue-last first")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read last exchange: %w", err)
+	}
+	var exchange lastExchange
+	if err := json.Unmarshal(data, &exchange); err != nil {
+		return nil, fmt.Errorf("failed to parse last exchange %s: %w", path, err)
+	}
+	return &exchange, nil
+}
@@ -1,14 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
 )
 
-const (
-	baseURL = "https://generativelanguage.googleapis.com/v1beta"
-)
+const apiHost = "https://generativelanguage.googleapis.com"
+
+// apiVersion is the version segment of API URLs, set with --api-version.
+var apiVersion = "v1beta"
+
+func baseURL() string {
+	return apiHost + "/" + apiVersion
+}
+
+func uploadBaseURL() string {
+	return apiHost + "/upload/" + apiVersion
+}
 
 func main() {
 	if len(os.Args) < 2 {
@@ -16,10 +31,40 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Shared by the --retry-status-codes flag of each command that retries
+	var retryStatusCodes []int
+
 	// Common flags for generate command
-	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
+	generateCmd := flag.NewFlagSet("generate", flag.ContinueOnError)
 	modelName := generateCmd.String("model", "", "Model name (e.g., models/gemini-1.5-flash-latest)")
 	systemInstructionStr := generateCmd.String("system-instruction", "", "System instruction text (default: \"\")")
+	compactSystemInstruction := generateCmd.String("compact-system-instruction", "", "Collapse whitespace in the system instruction text before sending: light (runs of spaces and blank lines, keeping line breaks and indentation) or full (all whitespace to single spaces) (default: \"\")")
+	replaceSystemInstruction := generateCmd.Bool("replace-system-instruction", false, "Use only --system-instruction instead of appending it to the base system instruction from config (default: false)")
+	var systemInstructionFiles stringSliceFlag
+	generateCmd.Var(&systemInstructionFiles, "system-instruction-file", "File to add to the system instruction as inline data, same formats as file parts. May be repeated.")
+
+	// Part processing flags
+	promptPrefix := generateCmd.String("prompt-prefix", "", "Text prepended to the first text part, as a string or @/path/to/file (default: \"\")")
+	promptSuffix := generateCmd.String("prompt-suffix", "", "Text appended to the last text part, as a string or @/path/to/file (default: \"\")")
+	continueLast := generateCmd.Bool("continue-last", false, "Send the previous generate prompt and answer as earlier turns, making this call a follow-up to it (default: false)")
+	keepGoing := generateCmd.Bool("keep-going", false, "With several prompts separated by --- among the parts, run the remaining prompts after one fails and report the failures at the end (default: false)")
+	editPrompt := generateCmd.Bool("edit", false, "Compose the text prompt in $EDITOR; it is added after any parts given as arguments (default: false)")
+	concatText := generateCmd.Bool("concat-text", false, "Join adjacent text parts into a single part; file parts stay in place (default: false)")
+	concatSeparator := generateCmd.String("concat-separator", "\n\n", "Separator placed between text parts joined by --concat-text")
+	trimParts := generateCmd.Bool("trim-parts", false, "Strip a UTF-8 BOM and leading/trailing whitespace from text/* file parts (default: false)")
+	stripImageMetadata := generateCmd.Bool("strip-image-metadata", false, "Re-encode JPEG/PNG file parts to drop EXIF and other metadata. JPEGs are re-compressed, so bytes will differ. (default: false)")
+	splitChunks := generateCmd.Bool("split-chunks", false, "Split the text-file part into chunks and send one request per chunk, with the other parts and settings shared; answers are printed in order. Requires --format text. (default: false)")
+	chunkTokens := generateCmd.Int("chunk-tokens", 8000, "Approximate size of each --split-chunks chunk in tokens, estimated at 4 characters per token")
+	chunkOverlap := generateCmd.Int("chunk-overlap", 200, "Approximate number of tokens each --split-chunks chunk repeats from the end of the previous one")
+	partsFromCSV := generateCmd.String("parts-from-csv", "", "Send one request per row of this CSV file, adding the row's prompt column as a text part after any parts given as arguments. Columns temperature, top_p, top_k, max_output_tokens and system_instruction override the flags for their row. (default: \"\")")
+	csvPromptColumn := generateCmd.String("csv-prompt-column", "prompt", "--parts-from-csv column holding the prompt text")
+	csvAnswerColumn := generateCmd.String("csv-answer-column", "answer", "Column the answer is written to in the --parts-from-csv output; added unless the input already has it")
+	csvOutput := generateCmd.String("csv-output", "", "File to write the --parts-from-csv output to instead of stdout (default: \"\")")
+	csvSummaryPath := generateCmd.String("csv-summary", "", "Also write the --parts-from-csv tally of finish reasons and error kinds to this JSON file (default: \"\")")
+	maxParts := generateCmd.Int("max-parts", 1000, "Refuse to run with more input parts than this, e.g. from a glob matching far more files than intended; 0 disables")
+	dedupeParts := generateCmd.Bool("dedupe-parts", false, "Drop parts whose content exactly matches an earlier part, e.g. from overlapping globs (default: false)")
+	cachedContent := generateCmd.String("cached-content", "", "Use a system instruction cached with create-cache (e.g. cachedContents/abc123) instead of sending one. Must be created for the same model. (default: \"\")")
+	partTextEncoding := generateCmd.String("part-text-encoding", "utf-8", "Encoding of text-file parts: utf-8, latin1, utf-16le or utf-16be (default: utf-8)")
 
 	// GenerationConfig flags
 	temperature := generateCmd.Float64("temperature", -1.0, "Temperature for generation (e.g., 0.7). API default if not set or < 0.")
@@ -29,12 +74,26 @@ func main() {
 	stopSequence := generateCmd.String("stop-sequence", "", "A single stop sequence string (default: \"\")")
 	responseMimeType := generateCmd.String("response-mime-type", "", "Response MIME type (e.g., application/json) (default: \"\")")
 	responseSchemaFileOrJSON := generateCmd.String("response-schema", "", "OpenAPI subset schema as JSON string or @/path/to/schema.json (default: \"\")")
+	generationConfigFileOrJSON := generateCmd.String("generation-config", "", "Whole generationConfig as a JSON string or @/path/to/config.json; individual flags such as --temperature override its fields (default: \"\")")
+	responseSchemaFromExample := generateCmd.String("response-schema-from-example", "", "Infer --response-schema from an example of the desired output, as a JSON string or @/path/to/example.json (default: \"\")")
+	dryRunSchema := generateCmd.Bool("dry-run-schema", false, "Print the schema inferred by --response-schema-from-example and exit without calling the API (default: false)")
+	responseSchemaPatch := generateCmd.String("response-schema-patch", "", "JSON object, or @/path/to/patch.json, whose top-level keys replace those of --response-schema, e.g. '{\"required\":[\"x\"]}' (default: \"\")")
+	resolveSchemaRefsFlag := generateCmd.Bool("resolve-schema-refs", false, "Inline local $ref references (e.g. \"#/$defs/address\") in --response-schema before sending, and drop $defs/definitions (default: false)")
+	jsonMode := generateCmd.Bool("json", false, "Ask for JSON: sets --response-mime-type application/json, adds an any-object schema unless one is given, and resends up to 2 times if the answer still isn't valid JSON (default: false)")
+	responseEnum := generateCmd.String("response-enum", "", "Comma-separated labels the answer must be exactly one of, e.g. 'positive,negative,neutral'. Builds an enum --response-schema and sets --response-mime-type text/x.enum (default: \"\")")
+	propertyOrder := generateCmd.String("property-order", "", "Property names in the order the answer should list them, comma-separated or @/path/to/file with one per line. Set as propertyOrdering on every object in --response-schema; unlisted properties follow in declared order, with a warning. (default: \"\")")
+	strictSchema := generateCmd.Bool("strict-schema", false, "Add propertyOrdering to --response-schema object schemas, following the order properties are declared (default: false)")
 
 	// ThinkingConfig flags
 	thinkingBudget := generateCmd.Int("thinking-budget", -1, "Thinking budget for 2.5 models (0-24576). API default/behavior if not set or < 0.")
 	includeThoughts := generateCmd.Bool("include-thoughts", false, "Include thought summaries (experimental for 2.5 models) (default: false)")
 
 	// Tools flags
+	functionDeclarations := generateCmd.String("function-declarations", "", "JSON array of function declarations, as a string or @/path/to/functions.json (default: \"\")")
+	toolHandler := generateCmd.String("tool-handler", "", "Command run for each functionCall: receives the call as JSON on stdin and prints a functionResponse on stdout. Calls are run in parallel and the results sent back until the model answers. (default: \"\")")
+	maxToolTurns := generateCmd.Int("max-tool-turns", 10, "Maximum number of function-calling round trips with --tool-handler")
+	functionCallingMode := generateCmd.String("function-calling-mode", "", "Function calling mode: AUTO, ANY (force a call) or NONE (disable calls) (default: \"\")")
+	allowedFunctions := generateCmd.String("allowed-functions", "", "Comma-separated function names the model may call; requires --function-calling-mode ANY (default: \"\")")
 	toolURLContext := generateCmd.Bool("tool-url-context", false, "Enable URL context tool (default: false)")
 	toolGoogleSearch := generateCmd.Bool("tool-google-search", false, "Enable Google Search tool (default: false)")
 	toolGoogleSearchRetrieval := generateCmd.Bool("tool-google-search-retrieval", false, "Enable Google Search Retrieval tool (for 1.5 models) (default: false)")
@@ -42,47 +101,365 @@ func main() {
 	toolGoogleSearchRetrievalThreshold := generateCmd.Float64("tool-gsr-threshold", -1.0, "Threshold for dynamic Google Search Retrieval. Used if --tool-google-search-retrieval is true and mode is dynamic. API default if < 0. (default: -1.0)")
 
 	// Safety Settings flag
-	safetySettingsStr := generateCmd.String("safety-settings", "", "Comma-separated safety settings, e.g., \"HARM_CATEGORY_HARASSMENT:BLOCK_ONLY_HIGH,HARM_CATEGORY_HATE_SPEECH:BLOCK_MEDIUM_AND_ABOVE\" (default: \"\")")
+	safetySettingsStr := generateCmd.String("safety-settings", "", "Comma-separated safety settings, e.g., \"HARM_CATEGORY_HARASSMENT:BLOCK_ONLY_HIGH,HARM_CATEGORY_HATE_SPEECH:BLOCK_MEDIUM_AND_ABOVE\". Overrides the stored default for each listed category. (default: \"\")")
+
+	// Record/replay flags
+	recordPath := generateCmd.String("record", "", "Record the raw API response to this cassette file, keyed by a hash of the request (default: \"\")")
+	replayPath := generateCmd.String("replay", "", "Replay a recorded response from this cassette file on a cache hit instead of calling the API (default: \"\")")
+
+	// Files API flags
+	autoFileAPI := generateCmd.Bool("auto-file-api", false, "When inline parts exceed the 20MB request limit, upload the largest ones with the Files API instead of failing (default: false)")
+	fileWaitTimeout := generateCmd.Duration("file-wait-timeout", 5*time.Minute, "How long to wait for referenced uploaded files to become ACTIVE")
+	uploadTimeout := generateCmd.Duration("upload-timeout", 30*time.Minute, "Give up on each Files API upload made by --auto-file-api or --inline-threshold after this long; 0 disables")
+	generateTimeout := generateCmd.Duration("generate-timeout", 10*time.Minute, "Give up on each generate request after this long, counting retries and the waits between them; 0 disables")
+	inlineThreshold := generateCmd.String("inline-threshold", "7MB", "Upload file parts larger than this with the Files API and send smaller ones inline; 0 sends everything inline")
+
+	// Fixture flags
+	saveRequestOnly := generateCmd.Bool("save-request-only", false, "Write the request JSON to --fixture-dir/--fixture-name.json instead of sending it (default: false)")
+	fixtureName := generateCmd.String("fixture-name", "", "File name (without .json) for --save-request-only")
+	fixtureDir := generateCmd.String("fixture-dir", ".", "Directory for --save-request-only fixtures")
+
+	// Preflight flags
+	force := generateCmd.Bool("force", false, "Skip the model capability preflight check, a model lookup made when thinking or search and URL context tools are requested (default: false)")
+
+	// Rate limiting flags
+	maxRetries := generateCmd.Int("max-retries", 3, "Retry rate-limit (429), transient server (5xx) and dropped-connection errors this many times, honoring Retry-After")
+	registerRetryStatusFlag(generateCmd, &retryStatusCodes)
+	retryNotFoundCount := generateCmd.Int("retry-not-found", 0, "Retry this many times with backoff when the model returns 404, e.g. for a freshly created tuned model. Fails fast if 0. (default: 0)")
+	targetRPM := generateCmd.Float64("target-rpm", 0, "Share a requests-per-minute budget with all gemini-cli processes through a lock file in the config directory. Off if 0. (default: 0)")
+
+	// Output flags
+	outputFormat := generateCmd.String("format", "json", "Output format: json (raw API response), text (answer text only), json-answer (the answer text parsed and re-indented as JSON), csv (answer parsed as a JSON array of objects; use with --response-schema) or base64 (each inlineData part as \"<mime type>\\t<base64 data>\", one per line). Defaults to $GEMINI_CLI_OUTPUT_FORMAT, then default_output_format from config, else json.")
+	outputJSONOnlyAnswer := generateCmd.Bool("output-json-only-answer", false, "Shorthand for --format json-answer (default: false)")
+	stripMarkdownOutput := generateCmd.Bool("strip-markdown", false, "With --format text, remove Markdown formatting from the answer, keeping text and list items as plain lines (default: false)")
+	extractJSONFlag := generateCmd.Bool("extract-json", false, "Pull the first JSON object or array out of the answer text, looking inside ```json fences and past surrounding prose, and print it indented; fails if there is none. Implies --format json-answer without JSON mode. (default: false)")
+	minify := generateCmd.Bool("minify", false, "With --format json or json-answer, print compact single-line JSON (default: false)")
+	outputTemplate := generateCmd.String("output-template", "", "Go text/template used to print the response instead of --format, as a string or @/path/to/file. Fields: .Text, .Model, .FinishReason, .Usage, .Response (default: \"\")")
+	failIfEmptyText := generateCmd.Bool("fail-if-empty-text", false, "Exit non-zero, without printing the response, when the answer has no text (e.g. only a function call or an image), naming what it has instead on stderr (default: false)")
+	verbose := generateCmd.Bool("verbose", false, "Print request diagnostics to stderr (default: false)")
+	showRequestSize := generateCmd.Bool("show-request-size", false, "Print the marshaled request size to stderr before sending (default: false)")
+	echoPrompt := generateCmd.Bool("echo-prompt", false, "Print the resolved prompt text and a summary of non-text parts before the response (default: false)")
+	prettyParts := generateCmd.Bool("pretty-parts", false, "Print a readable preview of the request, with text parts wrapped, file parts as [file: name, mime type, size], the system instruction and the effective generation config, and exit without sending it (default: false)")
+	showSafety := generateCmd.Bool("show-safety", false, "Print the response's safety ratings (category: probability) to stderr (default: false)")
+	detailedUsage := generateCmd.Bool("detailed-usage", false, "Print token usage to stderr, including the per-modality breakdown when the API returns one (default: false)")
+	thinkingWarnRatio := generateCmd.Float64("thinking-warn-ratio", 3.0, "Warn on stderr when thinking tokens exceed this multiple of answer tokens; 0 disables the warning")
+	showRetries := generateCmd.Bool("show-retries", false, "Print a summary of attempts, retry triggers and backoff time to stderr (default: false)")
+	estimateCost := generateCmd.Bool("estimate-cost", false, "Print an estimated USD cost to stderr using the usageMetadata of every response in the run and the pricing table (default: false)")
+	transcriptPath := generateCmd.String("transcript", "", "Append the prompt and answer to this Markdown file, with a timestamp and model name (default: \"\")")
+	printPromptHash := generateCmd.Bool("print-prompt-hash", false, "Print a SHA-256 of the model and resolved request (canonical JSON) to stderr, for keying external caches (default: false)")
+	promptHashFile := generateCmd.String("prompt-hash-file", "", "Write the prompt hash (see --print-prompt-hash) to this file, one line per request (default: \"\")")
 
 	// Set-config command
-	setConfigCmd := flag.NewFlagSet("set-config", flag.ExitOnError)
+	setConfigCmd := flag.NewFlagSet("set-config", flag.ContinueOnError)
 	apiKey := setConfigCmd.String("key", "", "Gemini API Key")
+	keyPoolStr := setConfigCmd.String("key-pool", "", "Comma-separated API keys for --key-rotation. Replaces any stored pool. (default: \"\")")
+	defaultSafetySettingsStr := setConfigCmd.String("safety-settings", "", "Default safety settings applied to every generate call, same format as generate --safety-settings. Replaces any stored defaults. (default: \"\")")
+	baseSystemInstruction := setConfigCmd.String("system-instruction", "", "Base system instruction sent before any per-call --system-instruction (default: \"\")")
+	defaultOutputFormat := setConfigCmd.String("default-output-format", "", "Output format generate uses when --format is not given (default: \"\")")
 
 	// List-models command
-	listModelsCmd := flag.NewFlagSet("list-models", flag.ExitOnError)
+	listModelsCmd := flag.NewFlagSet("list-models", flag.ContinueOnError)
+	listModelsFormat := listModelsCmd.String("format", "json", "Output format: json or table")
+	listModelsSort := listModelsCmd.String("sort", "name", "Sort by name, display-name, input-limit or output-limit")
+	listModelsReverse := listModelsCmd.Bool("reverse", false, "Reverse the sort order (default: false)")
+	listModelsOnlyText := listModelsCmd.Bool("only-text", false, "Only list models usable for text generation with generate (default: false)")
+	listModelsShort := listModelsCmd.Bool("short", false, "Print one \"name — input/output tokens\" line per model instead of --format output (default: false)")
+
+	// Upload-file command
+	uploadFileCmd := flag.NewFlagSet("upload-file", flag.ContinueOnError)
+	uploadPath := uploadFileCmd.String("path", "", "Path to the local file to upload")
+	uploadDisplayName := uploadFileCmd.String("display-name", "", "Display name for the uploaded file (default: file name)")
+	uploadMimeType := uploadFileCmd.String("mime-type", "", "MIME type of the file (default: detected from extension/content)")
+	uploadFileTimeout := uploadFileCmd.Duration("upload-timeout", 30*time.Minute, "Give up on the upload after this long; 0 disables")
+
+	// File management commands
+	listFilesCmd := flag.NewFlagSet("list-files", flag.ContinueOnError)
+	getFileCmd := flag.NewFlagSet("get-file", flag.ContinueOnError)
+	getFileName := getFileCmd.String("name", "", "File name (e.g., files/abc123)")
+	deleteFileCmd := flag.NewFlagSet("delete-file", flag.ContinueOnError)
+	deleteFileName := deleteFileCmd.String("name", "", "File name (e.g., files/abc123)")
+
+	// Benchmark command
+	benchmarkCmd := flag.NewFlagSet("benchmark", flag.ContinueOnError)
+	benchModelName := benchmarkCmd.String("model", "", "Model name (e.g., models/gemini-2.5-flash)")
+	benchPrompt := benchmarkCmd.String("prompt", "", "Prompt sent with every request, as a string or @/path/to/file. {{n}} is replaced with the request number.")
+	benchRequests := benchmarkCmd.Int("requests", 10, "Total number of requests to send")
+	benchConcurrency := benchmarkCmd.Int("concurrency", 1, "Number of requests in flight at once")
+	benchMaxOutputTokens := benchmarkCmd.Int("max-output-tokens", -1, "Max output tokens per request. API default if < 0. (default -1)")
+	benchMaxRetries := benchmarkCmd.Int("max-retries", 3, "Retry rate-limit (429), transient server (5xx) and dropped-connection errors this many times per request")
+	registerRetryStatusFlag(benchmarkCmd, &retryStatusCodes)
+	benchTargetRPM := benchmarkCmd.Float64("target-rpm", 0, "Share a requests-per-minute budget with all gemini-cli processes. Off if 0. (default: 0)")
+
+	// Create-cache command
+	createCacheCmd := flag.NewFlagSet("create-cache", flag.ContinueOnError)
+	cacheModelName := createCacheCmd.String("model", "", "Model the cache will be used with (e.g., models/gemini-2.5-flash)")
+	cacheSystemInstruction := createCacheCmd.String("system-instruction", "", "System instruction to cache, as a string or @/path/to/file")
+	cacheDisplayName := createCacheCmd.String("display-name", "", "Display name for the cache (default: \"\")")
+	cacheTTL := createCacheCmd.Duration("ttl", time.Hour, "How long the cache lives; storage is billed for this time")
+
+	// Update-cache command
+	updateCacheCmd := flag.NewFlagSet("update-cache", flag.ContinueOnError)
+	updateCacheName := updateCacheCmd.String("name", "", "Cache to update (e.g., cachedContents/abc123)")
+	updateCacheTTL := updateCacheCmd.Duration("ttl", time.Hour, "New lifetime, counted from now; storage is billed for this time")
+
+	// Count-tokens command
+	countTokensCmd := flag.NewFlagSet("count-tokens", flag.ContinueOnError)
+	countModelName := countTokensCmd.String("model", "", "Model name (e.g., models/gemini-2.5-flash)")
+	countFormat := countTokensCmd.String("format", "table", "Output format: table or json")
+	countConcurrency := countTokensCmd.Int("concurrency", 4, "Number of files counted at once")
+	countEstimateCost := countTokensCmd.Bool("estimate-cost", false, "Add the estimated input cost per file and in total, using the pricing table (default: false)")
+	countMaxRetries := countTokensCmd.Int("max-retries", 3, "Retry rate-limit (429), transient server (5xx) and dropped-connection errors this many times per file")
+	registerRetryStatusFlag(countTokensCmd, &retryStatusCodes)
+	countAbortOnFirstError := countTokensCmd.Bool("abort-on-first-error", false, "Stop starting new files once one fails (after retries) and exit non-zero; files already in flight finish (default: false)")
+	countResponseSchema := countTokensCmd.String("response-schema", "", "Also count a response schema, as a JSON string or @/path/to/schema.json, sent as generate would send it (default: \"\")")
+	countCachedContent := countTokensCmd.String("cached-content", "", "Count each file as a prompt that uses this cache (e.g. cachedContents/abc123), showing the file's own tokens and the cache's tokens separately (default: \"\")")
+	countFunctionDeclarations := countTokensCmd.String("function-declarations", "", "Also count a JSON array of function declarations, as a string or @/path/to/functions.json (default: \"\")")
+
+	// Probe command
+	probeCmd := flag.NewFlagSet("probe", flag.ContinueOnError)
+	probeTimeout := probeCmd.Duration("timeout", 15*time.Second, "Give up on reaching the API after this long")
+	// List safety options command; it takes no flags beyond the error flags
+	listSafetyOptionsCmd := flag.NewFlagSet("list-safety-options", flag.ContinueOnError)
+
+	for _, fs := range []*flag.FlagSet{generateCmd, listModelsCmd, uploadFileCmd, listFilesCmd, getFileCmd, deleteFileCmd, benchmarkCmd, countTokensCmd, createCacheCmd, updateCacheCmd, probeCmd} {
+		registerTLSFlags(fs)
+		registerDebugFlags(fs)
+		registerAPIVersionFlags(fs)
+		registerKeyRotationFlags(fs)
+	}
+	for _, fs := range []*flag.FlagSet{deleteFileCmd} {
+		registerConfirmFlags(fs)
+	}
+	registerErrorFlags(listSafetyOptionsCmd)
+	for _, fs := range []*flag.FlagSet{setConfigCmd, generateCmd, listModelsCmd, uploadFileCmd, listFilesCmd, getFileCmd, deleteFileCmd, benchmarkCmd, countTokensCmd, createCacheCmd, updateCacheCmd, probeCmd} {
+		registerErrorFlags(fs)
+		registerStoreFlags(fs)
+	}
+	registerFetchFlags(generateCmd)
+	for _, fs := range []*flag.FlagSet{generateCmd, uploadFileCmd} {
+		registerSniffFlags(fs)
+	}
 
 	generateCmd.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s generate --model <model_name> [options] [part_type_1 part_value_1 ...]\n", os.Args[0])
-		fmt.Fprintln(os.Stderr, "\nOptions:")
+		fmt.Fprintf(generateCmd.Output(), "Usage: %s generate --model <model_name> [options] [part_type_1 part_value_1 ...]\n", os.Args[0])
+		fmt.Fprintln(generateCmd.Output(), "\nOptions:")
 		generateCmd.PrintDefaults()
-		fmt.Fprintln(os.Stderr, "\nPart Types and Values:")
-		fmt.Fprintln(os.Stderr, "  text \"your text string\"")
-		fmt.Fprintln(os.Stderr, "  file \"@/path/to/local/file\"")
-		fmt.Fprintln(os.Stderr, "  file \"http(s)://url/to/file\"")
-		fmt.Fprintln(os.Stderr, "  file \"file:///path/to/local/file\"")
-		fmt.Fprintln(os.Stderr, "  file \"data:mime/type;base64,ABC...\"")
-		fmt.Fprintln(os.Stderr, "\nExample:")
-		fmt.Fprintf(os.Stderr, "  %s generate --model models/gemini-1.5-flash-latest text \"Describe this image\" file \"@/path/to/image.jpg\"\n", os.Args[0])
+		fmt.Fprintln(generateCmd.Output(), "\nPart Types and Values:")
+		fmt.Fprintln(generateCmd.Output(), "  text \"your text string\"")
+		fmt.Fprintln(generateCmd.Output(), "  file \"@/path/to/local/file\"")
+		fmt.Fprintln(generateCmd.Output(), "  file \"http(s)://url/to/file\"")
+		fmt.Fprintln(generateCmd.Output(), "  file \"file:///path/to/local/file\"")
+		fmt.Fprintln(generateCmd.Output(), "  file \"data:mime/type;base64,ABC...\"")
+		fmt.Fprintln(generateCmd.Output(), "  file \"files/abc123\" (a file uploaded with upload-file)")
+		fmt.Fprintln(generateCmd.Output(), "  file:LABEL \"@/path/to/file\" (any file form above, preceded by a text part such as \"Image 1 (LABEL):\")")
+		fmt.Fprintln(generateCmd.Output(), "  text-file \"@/path/to/file\" (any local or remote file form above, sent as text; see --part-text-encoding)")
+		fmt.Fprintln(generateCmd.Output(), "\nExample:")
+		fmt.Fprintf(generateCmd.Output(), "  %s generate --model models/gemini-1.5-flash-latest text \"Describe this image\" file \"@/path/to/image.jpg\"\n", os.Args[0])
+	}
+
+	// --json-errors may also come before the command, so that errors about
+	// the command itself are reported as JSON. Registering the flag above
+	// resets it, so this has to come after.
+	if os.Args[1] == "--json-errors" || os.Args[1] == "-json-errors" {
+		jsonErrors = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		if len(os.Args) < 2 {
+			exitWithError(errorKindUsage, "Error: no command given", nil)
+		}
 	}
 
 	switch os.Args[1] {
 	case "set-config":
-		setConfigCmd.Parse(os.Args[2:])
-		if *apiKey == "" {
-			fmt.Fprintln(os.Stderr, "Error: --key is required for set-config")
-			setConfigCmd.Usage()
-			os.Exit(1)
+		parseFlags(setConfigCmd, os.Args[2:])
+		if noStore {
+			configErrorf("Error: set-config saves settings to the config file and can't be used with --no-store")
+		}
+		if *apiKey == "" && *keyPoolStr == "" && *defaultSafetySettingsStr == "" && *baseSystemInstruction == "" && *defaultOutputFormat == "" {
+			usageErrorf(setConfigCmd, "Error: --key, --key-pool, --safety-settings, --system-instruction or --default-output-format is required for set-config")
 		}
-		handleSetConfig(*apiKey)
+		handleSetConfig(*apiKey, *keyPoolStr, *defaultSafetySettingsStr, *baseSystemInstruction, *defaultOutputFormat)
 	case "generate":
-		generateCmd.Parse(os.Args[2:])
+		parseFlags(generateCmd, os.Args[2:])
+		if *responseSchemaFromExample != "" {
+			if *responseSchemaFileOrJSON != "" {
+				usageErrorf(generateCmd, "Error: --response-schema-from-example and --response-schema are mutually exclusive")
+			}
+			example, err := readFileOrString(*responseSchemaFromExample)
+			if err != nil {
+				usageErrorf(generateCmd, "Error reading --response-schema-from-example: %v", err)
+			}
+			schema, err := inferSchemaFromExample(example)
+			if err != nil {
+				usageErrorf(generateCmd, "Error: --response-schema-from-example: %v", err)
+			}
+			if *dryRunSchema {
+				var indented bytes.Buffer
+				if err := json.Indent(&indented, []byte(schema), "", "  "); err != nil {
+					fatalf("Error formatting inferred schema: %v", err)
+				}
+				fmt.Println(indented.String())
+				break
+			}
+			*responseSchemaFileOrJSON = schema
+			if *responseMimeType == "" {
+				*responseMimeType = "application/json"
+			}
+		} else if *dryRunSchema {
+			usageErrorf(generateCmd, "Error: --dry-run-schema requires --response-schema-from-example")
+		}
 		if *modelName == "" {
-			fmt.Fprintln(os.Stderr, "Error: --model is required for generate")
-			generateCmd.Usage()
-			os.Exit(1)
+			usageErrorf(generateCmd, "Error: --model is required for generate")
 		}
+		refuseWithNoStore(generateCmd, "record", "transcript", "prompt-hash-file", "save-request-only", "edit", "target-rpm", "continue-last", "csv-output", "csv-summary")
+
+		config, err := resolveConfig()
+		if err != nil {
+			configErrorf("Error loading config: %v", err)
+		}
+		if config.APIKey == "" {
+			configErrorf("Error loading API key: no API key found in %s or the config file. Please run 'set-config --key YOUR_KEY'.", envAPIKey)
+		}
+		if !flagWasSet(generateCmd, "format") {
+			*outputFormat = config.DefaultOutputFormat
+		}
+		if *outputJSONOnlyAnswer {
+			*outputFormat = "json-answer"
+		}
+		if *extractJSONFlag {
+			if flagWasSet(generateCmd, "format") && *outputFormat != "json-answer" {
+				usageErrorf(generateCmd, "Error: --extract-json prints JSON and cannot be combined with --format %s", *outputFormat)
+			}
+			*outputFormat = "json-answer"
+		}
+		if !isValidOutputFormat(*outputFormat) {
+			usageErrorf(generateCmd, "Error: invalid --format '%s'. Must be one of: %s", *outputFormat, strings.Join(outputFormats, ", "))
+		}
+		var parsedTemplate *template.Template
+		if *outputTemplate != "" {
+			templateText, err := readFileOrString(*outputTemplate)
+			if err != nil {
+				usageErrorf(generateCmd, "Error reading --output-template: %v", err)
+			}
+			parsedTemplate, err = template.New("output").Option("missingkey=error").Parse(templateText)
+			if err != nil {
+				usageErrorf(generateCmd, "Error: invalid --output-template: %v", err)
+			}
+		}
+		if *cachedContent != "" && (*systemInstructionStr != "" || len(systemInstructionFiles) > 0) {
+			usageErrorf(generateCmd, "Error: --cached-content already supplies the system instruction; drop --system-instruction/--system-instruction-file")
+		}
+		if *minify && *outputFormat != "json" && *outputFormat != "json-answer" {
+			usageErrorf(generateCmd, "Error: --minify requires --format json or json-answer")
+		}
+		if *responseSchemaPatch != "" && *responseSchemaFileOrJSON == "" {
+			usageErrorf(generateCmd, "Error: --response-schema-patch requires --response-schema")
+		}
+		if *resolveSchemaRefsFlag && *responseSchemaFileOrJSON == "" {
+			usageErrorf(generateCmd, "Error: --resolve-schema-refs requires --response-schema")
+		}
+		var propertyOrderNames []string
+		if *propertyOrder != "" {
+			if *responseSchemaFileOrJSON == "" {
+				usageErrorf(generateCmd, "Error: --property-order requires --response-schema")
+			}
+			list, err := readFileOrString(*propertyOrder)
+			if err != nil {
+				fatalf("Error reading --property-order: %v", err)
+			}
+			if propertyOrderNames, err = parsePropertyOrder(list); err != nil {
+				usageErrorf(generateCmd, "Error: invalid --property-order: %v", err)
+			}
+		}
+		if *stripMarkdownOutput && *outputFormat != "text" && *partsFromCSV == "" {
+			usageErrorf(generateCmd, "Error: --strip-markdown requires --format text")
+		}
+		if *compactSystemInstruction != "" && !slices.Contains(compactLevels, *compactSystemInstruction) {
+			usageErrorf(generateCmd, "Error: invalid --compact-system-instruction '%s'. Must be one of: %s", *compactSystemInstruction, strings.Join(compactLevels, ", "))
+		}
+		if !slices.Contains(textEncodings, *partTextEncoding) {
+			usageErrorf(generateCmd, "Error: invalid --part-text-encoding '%s'. Must be one of: %s", *partTextEncoding, strings.Join(textEncodings, ", "))
+		}
+		if *saveRequestOnly && *fixtureName == "" {
+			usageErrorf(generateCmd, "Error: --fixture-name is required with --save-request-only")
+		}
+		if *splitChunks {
+			switch {
+			case *outputFormat != "text":
+				usageErrorf(generateCmd, "Error: --split-chunks requires --format text")
+			case *outputTemplate != "" || *saveRequestOnly || *continueLast:
+				usageErrorf(generateCmd, "Error: --split-chunks cannot be combined with --output-template, --save-request-only or --continue-last")
+			case *chunkTokens < 1 || *chunkOverlap < 0 || *chunkOverlap >= *chunkTokens:
+				usageErrorf(generateCmd, "Error: --chunk-tokens must be at least 1 and --chunk-overlap between 0 and --chunk-tokens")
+			}
+		}
+		if *partsFromCSV != "" {
+			switch {
+			case *splitChunks || *outputTemplate != "" || *saveRequestOnly || *continueLast:
+				usageErrorf(generateCmd, "Error: --parts-from-csv cannot be combined with --split-chunks, --output-template, --save-request-only or --continue-last")
+			case *csvPromptColumn == *csvAnswerColumn:
+				usageErrorf(generateCmd, "Error: --csv-prompt-column and --csv-answer-column must differ")
+			}
+		} else if flagWasSet(generateCmd, "csv-output") || flagWasSet(generateCmd, "csv-summary") {
+			usageErrorf(generateCmd, "Error: --csv-output and --csv-summary require --parts-from-csv")
+		}
+		promptArgs, err := splitPromptArgs(generateCmd.Args())
+		if err != nil {
+			usageErrorf(generateCmd, "Error parsing input parts: %v", err)
+		}
+		if len(promptArgs) > 1 {
+			switch {
+			case *outputFormat != "json" && *outputFormat != "text" && *outputFormat != "json-answer":
+				usageErrorf(generateCmd, "Error: several prompts (separated by ---) require --format json, text or json-answer")
+			case *partsFromCSV != "" || *splitChunks || *outputTemplate != "" || *saveRequestOnly || *continueLast || *editPrompt:
+				usageErrorf(generateCmd, "Error: several prompts (separated by ---) cannot be combined with --parts-from-csv, --split-chunks, --output-template, --save-request-only, --continue-last or --edit")
+			}
+		} else if *keepGoing {
+			usageErrorf(generateCmd, "Error: --keep-going requires several prompts separated by ---")
+		}
+		if *prettyParts && (len(promptArgs) > 1 || *partsFromCSV != "" || *splitChunks || *saveRequestOnly) {
+			usageErrorf(generateCmd, "Error: --pretty-parts previews a single request and cannot be combined with several prompts, --parts-from-csv, --split-chunks or --save-request-only")
+		}
+		if *jsonMode {
+			if *responseMimeType != "" && *responseMimeType != "application/json" {
+				usageErrorf(generateCmd, "Error: --json sets --response-mime-type application/json; got '%s'", *responseMimeType)
+			}
+			*responseMimeType = "application/json"
+		}
+		// --extract-json is for answers that aren't in JSON mode
+		if (*outputFormat == "csv" || *outputFormat == "json-answer") && *responseMimeType == "" && !*extractJSONFlag {
+			*responseMimeType = "application/json"
+		}
+		var enumValues []string
+		if *responseEnum != "" {
+			var err error
+			if enumValues, err = parseEnumValues(*responseEnum); err != nil {
+				usageErrorf(generateCmd, "Error: invalid --response-enum: %v", err)
+			}
+			switch {
+			case *responseSchemaFileOrJSON != "" || *jsonMode:
+				usageErrorf(generateCmd, "Error: --response-enum cannot be combined with --response-schema or --json")
+			case *responseMimeType == "":
+				*responseMimeType = "text/x.enum"
+			case *responseMimeType != "text/x.enum" && *responseMimeType != "application/json":
+				usageErrorf(generateCmd, "Error: --response-enum needs --response-mime-type text/x.enum or application/json; got '%s'", *responseMimeType)
+			}
+		}
+
+		var partsInput PartsInput
+		partsInput.ConcatText = *concatText
+		partsInput.ConcatSeparator = *concatSeparator
+		partsInput.TrimParts = *trimParts
+		partsInput.StripImageMetadata = *stripImageMetadata
+		partsInput.DedupeParts = *dedupeParts
+		partsInput.CachedContent = *cachedContent
+		partsInput.TextEncoding = *partTextEncoding
+		partsInput.SystemInstructionFiles = systemInstructionFiles
+		partsInput.ReplaceSystemInstruction = *replaceSystemInstruction
+		partsInput.CompactSystemInstruction = *compactSystemInstruction
+		partsInput.ContinueLast = *continueLast
 
 		var genConfigInput GenerationConfigInput
+		genConfigInput.GenerationConfigFileOrJSON = *generationConfigFileOrJSON
 		genConfigInput.Temperature = *temperature
 		genConfigInput.MaxOutputTokens = *maxOutputTokens
 		genConfigInput.TopP = *topP
@@ -90,45 +467,308 @@ func main() {
 		genConfigInput.StopSequence = *stopSequence
 		genConfigInput.ResponseMimeType = *responseMimeType
 		genConfigInput.ResponseSchemaFileOrJSON = *responseSchemaFileOrJSON
+		genConfigInput.ResponseSchemaPatch = *responseSchemaPatch
+		genConfigInput.StrictSchema = *strictSchema
+		genConfigInput.PropertyOrder = propertyOrderNames
+		genConfigInput.PermissiveJSONSchema = *jsonMode
+		genConfigInput.ResolveSchemaRefs = *resolveSchemaRefsFlag
+		genConfigInput.ResponseEnum = enumValues
 		genConfigInput.ThinkingBudget = *thinkingBudget
 		genConfigInput.IncludeThoughts = *includeThoughts
 
 		var toolsInput ToolsInput
+		toolsInput.FunctionDeclarationsFileOrJSON = *functionDeclarations
+		toolsInput.ToolHandler = *toolHandler
+		toolsInput.MaxToolTurns = *maxToolTurns
+		toolsInput.FunctionCallingMode = *functionCallingMode
+		toolsInput.AllowedFunctions = *allowedFunctions
 		toolsInput.EnableURLContext = *toolURLContext
 		toolsInput.EnableGoogleSearch = *toolGoogleSearch
 		toolsInput.EnableGoogleSearchRetrieval = *toolGoogleSearchRetrieval
 		toolsInput.GoogleSearchRetrievalMode = *toolGoogleSearchRetrievalMode
 		toolsInput.GoogleSearchRetrievalThreshold = *toolGoogleSearchRetrievalThreshold
 
-		parsedParts, err := parseInputParts(generateCmd.Args())
+		var cassetteInput CassetteInput
+		cassetteInput.RecordPath = *recordPath
+		cassetteInput.ReplayPath = *replayPath
+
+		var filesInput FilesInput
+		filesInput.AutoFileAPI = *autoFileAPI
+		filesInput.WaitTimeout = *fileWaitTimeout
+		filesInput.UploadTimeout = *uploadTimeout
+		filesInput.InlineThreshold, err = parseByteSize(*inlineThreshold)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing input parts: %v\n", err)
-			generateCmd.Usage()
-			os.Exit(1)
+			usageErrorf(generateCmd, "Error: --inline-threshold: %v", err)
+		}
+
+		var retryInput RetryInput
+		retryInput.TargetRPM = *targetRPM
+		retryInput.MaxRetries = *maxRetries
+		retryInput.RetryStatusCodes = retryStatusCodes
+		retryInput.RetryNotFound = *retryNotFoundCount
+		retryInput.Timeout = *generateTimeout
+
+		var outputInput OutputInput
+		outputInput.Format = *outputFormat
+		outputInput.SaveRequestOnly = *saveRequestOnly
+		outputInput.PrettyParts = *prettyParts
+		outputInput.FailIfEmptyText = *failIfEmptyText
+		outputInput.ExtractJSON = *extractJSONFlag
+		outputInput.FixtureName = *fixtureName
+		outputInput.FixtureDir = *fixtureDir
+		outputInput.Verbose = *verbose
+		outputInput.ShowRequestSize = *showRequestSize
+		outputInput.EchoPrompt = *echoPrompt
+		outputInput.ShowSafety = *showSafety
+		outputInput.DetailedUsage = *detailedUsage
+		outputInput.EstimateCost = *estimateCost
+		outputInput.ThinkingWarnRatio = *thinkingWarnRatio
+		outputInput.ShowRetries = *showRetries
+		outputInput.TranscriptPath = *transcriptPath
+		outputInput.PrintPromptHash = *printPromptHash
+		outputInput.PromptHashFile = *promptHashFile
+		outputInput.StripMarkdown = *stripMarkdownOutput
+		outputInput.Minify = *minify
+		outputInput.Template = parsedTemplate
+		outputInput.RequireJSON = *jsonMode
+
+		prompts := make([][]ParsedPart, len(promptArgs))
+		for i, args := range promptArgs {
+			prompts[i], err = parseInputParts(args)
+			if err != nil {
+				usageErrorf(generateCmd, "Error parsing input parts: %v", err)
+			}
+			// Checked before anything is read or downloaded, so a runaway
+			// glob fails fast.
+			if *maxParts > 0 && len(prompts[i]) > *maxParts {
+				usageErrorf(generateCmd, "Error: %d input parts given, more than --max-parts %d", len(prompts[i]), *maxParts)
+			}
+		}
+		parsedParts := prompts[0]
+		if *editPrompt {
+			prompt, err := promptFromEditor()
+			if err != nil {
+				fatalf("Error reading prompt from editor: %v", err)
+			}
+			parsedParts = append(parsedParts, ParsedPart{Type: "text", Value: prompt})
+		}
+		var csvInput CSVInput
+		csvInput.Path = *partsFromCSV
+		csvInput.PromptColumn = *csvPromptColumn
+		csvInput.AnswerColumn = *csvAnswerColumn
+		csvInput.OutputPath = *csvOutput
+		csvInput.SummaryPath = *csvSummaryPath
+		if *promptPrefix != "" || *promptSuffix != "" {
+			prefix, err := readFileOrString(*promptPrefix)
+			if err != nil {
+				fatalf("Error reading --prompt-prefix: %v", err)
+			}
+			suffix, err := readFileOrString(*promptSuffix)
+			if err != nil {
+				fatalf("Error reading --prompt-suffix: %v", err)
+			}
+			if csvInput.Path != "" {
+				// Applied per row, once the row's prompt is added
+				csvInput.PromptPrefix, csvInput.PromptSuffix = prefix, suffix
+			} else {
+				for i := range prompts {
+					prompts[i] = wrapPrompt(prompts[i], prefix, suffix)
+				}
+				parsedParts = prompts[0]
+			}
+		}
+		// A base system instruction from config is enough on its own, unless
+		// --replace-system-instruction drops it
+		hasBaseInstruction := config.SystemInstruction != "" && !*replaceSystemInstruction
+		if len(parsedParts) == 0 && *systemInstructionStr == "" && !hasBaseInstruction && len(systemInstructionFiles) == 0 && csvInput.Path == "" {
+			usageErrorf(generateCmd, "Error: At least one input part (text/file) or system-instruction is required for generate.")
+		}
+
+		if !*force && *replayPath == "" && !*saveRequestOnly && !*prettyParts && needsPreflight(genConfigInput, toolsInput) {
+			if err := preflightModel(config.APIKey, *modelName, genConfigInput, toolsInput, retryInput); err != nil {
+				fatalf("Error: %v", err)
+			}
+		}
+
+		run := newGenerateRun(config, *modelName, *systemInstructionStr, partsInput, genConfigInput, toolsInput, *safetySettingsStr, cassetteInput, filesInput, retryInput, outputInput)
+		if len(prompts) > 1 {
+			handleMultiPromptGenerate(run, prompts, *keepGoing)
+			break
+		}
+		if csvInput.Path != "" {
+			handleCSVGenerate(run, parsedParts, csvInput)
+			break
 		}
-		if len(parsedParts) == 0 && *systemInstructionStr == "" {
-			fmt.Fprintln(os.Stderr, "Error: At least one input part (text/file) or system-instruction is required for generate.")
-			generateCmd.Usage()
-			os.Exit(1)
+		if *splitChunks {
+			handleChunkedGenerate(run, parsedParts, ChunkInput{ChunkTokens: *chunkTokens, ChunkOverlap: *chunkOverlap})
+			break
 		}
+		handleGenerateContent(run, parsedParts)
 
+	case "list-models":
+		parseFlags(listModelsCmd, os.Args[2:])
+		if *listModelsFormat != "json" && *listModelsFormat != "table" {
+			usageErrorf(listModelsCmd, "Error: invalid --format '%s'. Must be 'json' or 'table'", *listModelsFormat)
+		}
+		switch *listModelsSort {
+		case "name", "display-name", "input-limit", "output-limit":
+		default:
+			usageErrorf(listModelsCmd, "Error: invalid --sort '%s'. Must be 'name', 'display-name', 'input-limit' or 'output-limit'", *listModelsSort)
+		}
+		if *listModelsShort && flagWasSet(listModelsCmd, "format") {
+			usageErrorf(listModelsCmd, "Error: --short cannot be combined with --format")
+		}
+		var listInput ListModelsInput
+		listInput.Format = *listModelsFormat
+		listInput.Sort = *listModelsSort
+		listInput.Reverse = *listModelsReverse
+		listInput.OnlyText = *listModelsOnlyText
+		listInput.Short = *listModelsShort
+
+		currentApiKey, err := loadAPIKey()
+		if err != nil {
+			configErrorf("Error loading API key: %v. Please run 'set-config --key YOUR_KEY'.", err)
+		}
+		handleListModels(currentApiKey, listInput)
+	case "upload-file":
+		parseFlags(uploadFileCmd, os.Args[2:])
+		if *uploadPath == "" {
+			usageErrorf(uploadFileCmd, "Error: --path is required for upload-file")
+		}
+		currentApiKey, err := loadAPIKey()
+		if err != nil {
+			configErrorf("Error loading API key: %v. Please run 'set-config --key YOUR_KEY'.", err)
+		}
+		handleUploadFile(currentApiKey, *uploadPath, *uploadDisplayName, *uploadMimeType, quiet, *uploadFileTimeout)
+	case "list-files":
+		parseFlags(listFilesCmd, os.Args[2:])
 		currentApiKey, err := loadAPIKey()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error loading API key: %v. Please run 'set-config --key YOUR_KEY'.\n", err)
-			os.Exit(1)
+			configErrorf("Error loading API key: %v. Please run 'set-config --key YOUR_KEY'.", err)
+		}
+		handleListFiles(currentApiKey)
+	case "get-file":
+		parseFlags(getFileCmd, os.Args[2:])
+		if *getFileName == "" {
+			usageErrorf(getFileCmd, "Error: --name is required for get-file")
+		}
+		currentApiKey, err := loadAPIKey()
+		if err != nil {
+			configErrorf("Error loading API key: %v. Please run 'set-config --key YOUR_KEY'.", err)
+		}
+		handleGetFile(currentApiKey, *getFileName)
+	case "delete-file":
+		parseFlags(deleteFileCmd, os.Args[2:])
+		if *deleteFileName == "" {
+			usageErrorf(deleteFileCmd, "Error: --name is required for delete-file")
+		}
+		currentApiKey, err := loadAPIKey()
+		if err != nil {
+			configErrorf("Error loading API key: %v. Please run 'set-config --key YOUR_KEY'.", err)
+		}
+		handleDeleteFile(currentApiKey, *deleteFileName)
+	case "benchmark":
+		parseFlags(benchmarkCmd, os.Args[2:])
+		if *benchModelName == "" || *benchPrompt == "" {
+			usageErrorf(benchmarkCmd, "Error: --model and --prompt are required for benchmark")
+		}
+		refuseWithNoStore(benchmarkCmd, "target-rpm")
+		if *benchRequests < 1 || *benchConcurrency < 1 {
+			usageErrorf(benchmarkCmd, "Error: --requests and --concurrency must be at least 1")
+		}
+		promptTemplate, err := readFileOrString(*benchPrompt)
+		if err != nil {
+			fatalf("Error reading --prompt: %v", err)
 		}
 
-		handleGenerateContent(currentApiKey, *modelName, *systemInstructionStr, parsedParts, genConfigInput, toolsInput, *safetySettingsStr)
+		var benchInput BenchmarkInput
+		benchInput.Requests = *benchRequests
+		benchInput.Concurrency = *benchConcurrency
+		benchInput.MaxOutputTokens = *benchMaxOutputTokens
 
-	case "list-models":
-		listModelsCmd.Parse(os.Args[2:])
+		var retryInput RetryInput
+		retryInput.MaxRetries = *benchMaxRetries
+		retryInput.RetryStatusCodes = retryStatusCodes
+		retryInput.TargetRPM = *benchTargetRPM
+
+		currentApiKey, err := loadAPIKey()
+		if err != nil {
+			configErrorf("Error loading API key: %v. Please run 'set-config --key YOUR_KEY'.", err)
+		}
+		handleBenchmark(currentApiKey, *benchModelName, promptTemplate, benchInput, retryInput)
+	case "list-safety-options":
+		parseFlags(listSafetyOptionsCmd, os.Args[2:])
+		handleListSafetyOptions()
+	case "create-cache":
+		parseFlags(createCacheCmd, os.Args[2:])
+		if *cacheModelName == "" || *cacheSystemInstruction == "" {
+			usageErrorf(createCacheCmd, "Error: --model and --system-instruction are required for create-cache")
+		}
+		if *cacheTTL < time.Second {
+			usageErrorf(createCacheCmd, "Error: --ttl must be at least 1s")
+		}
+		systemInstruction, err := readFileOrString(*cacheSystemInstruction)
+		if err != nil {
+			fatalf("Error reading --system-instruction: %v", err)
+		}
+		currentApiKey, err := loadAPIKey()
+		if err != nil {
+			configErrorf("Error loading API key: %v. Please run 'set-config --key YOUR_KEY'.", err)
+		}
+		handleCreateCache(currentApiKey, *cacheModelName, systemInstruction, *cacheDisplayName, *cacheTTL)
+	case "update-cache":
+		parseFlags(updateCacheCmd, os.Args[2:])
+		if *updateCacheName == "" {
+			usageErrorf(updateCacheCmd, "Error: --name is required for update-cache")
+		}
+		if *updateCacheTTL < time.Second {
+			usageErrorf(updateCacheCmd, "Error: --ttl must be at least 1s")
+		}
 		currentApiKey, err := loadAPIKey()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error loading API key: %v. Please run 'set-config --key YOUR_KEY'.\n", err)
-			os.Exit(1)
+			configErrorf("Error loading API key: %v. Please run 'set-config --key YOUR_KEY'.", err)
+		}
+		handleUpdateCache(currentApiKey, *updateCacheName, *updateCacheTTL)
+	case "count-tokens":
+		parseFlags(countTokensCmd, os.Args[2:])
+		if *countModelName == "" || countTokensCmd.NArg() == 0 {
+			usageErrorf(countTokensCmd, "Error: --model and at least one file, directory or glob are required for count-tokens")
+		}
+		if *countFormat != "table" && *countFormat != "json" {
+			usageErrorf(countTokensCmd, "Error: invalid --format '%s'. Must be 'table' or 'json'", *countFormat)
+		}
+		if *countConcurrency < 1 {
+			usageErrorf(countTokensCmd, "Error: --concurrency must be at least 1")
+		}
+
+		var countInput CountTokensInput
+		countInput.Format = *countFormat
+		countInput.Concurrency = *countConcurrency
+		countInput.EstimateCost = *countEstimateCost
+		countInput.AbortOnFirstError = *countAbortOnFirstError
+		countInput.ResponseSchemaFileOrJSON = *countResponseSchema
+		countInput.FunctionDeclarationsFileOrJSON = *countFunctionDeclarations
+		countInput.CachedContent = *countCachedContent
+
+		var retryInput RetryInput
+		retryInput.MaxRetries = *countMaxRetries
+		retryInput.RetryStatusCodes = retryStatusCodes
+
+		config, err := resolveConfig()
+		if err != nil {
+			configErrorf("Error loading config: %v", err)
+		}
+		if config.APIKey == "" {
+			configErrorf("Error loading API key: no API key found in %s or the config file. Please run 'set-config --key YOUR_KEY'.", envAPIKey)
 		}
-		handleListModels(currentApiKey)
+		handleCountTokens(config, *countModelName, countTokensCmd.Args(), countInput, retryInput)
+	case "probe":
+		parseFlags(probeCmd, os.Args[2:])
+		handleProbe(*probeTimeout)
 	default:
+		if jsonErrors {
+			exitWithError(errorKindUsage, fmt.Sprintf("Error: unknown command '%s'", os.Args[1]), nil)
+		}
 		printTopLevelHelp()
 		os.Exit(1)
 	}
@@ -137,15 +777,33 @@ func main() {
 func printTopLevelHelp() {
 	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n", os.Args[0])
 	fmt.Fprintln(os.Stderr, "Commands:")
-	fmt.Fprintln(os.Stderr, "  set-config        Set the Gemini API key")
-	fmt.Fprintln(os.Stderr, "  generate          Generate content using a Gemini model")
-	fmt.Fprintln(os.Stderr, "  list-models       List available Gemini models")
+	fmt.Fprintln(os.Stderr, "  set-config           Set the Gemini API key")
+	fmt.Fprintln(os.Stderr, "  generate             Generate content using a Gemini model")
+	fmt.Fprintln(os.Stderr, "  list-models          List available Gemini models")
+	fmt.Fprintln(os.Stderr, "  list-safety-options  List valid --safety-settings categories and thresholds")
+	fmt.Fprintln(os.Stderr, "  upload-file          Upload a file with the Files API")
+	fmt.Fprintln(os.Stderr, "  list-files           List files uploaded with the Files API")
+	fmt.Fprintln(os.Stderr, "  get-file             Show metadata and state of an uploaded file")
+	fmt.Fprintln(os.Stderr, "  delete-file          Delete an uploaded file")
+	fmt.Fprintln(os.Stderr, "  benchmark            Measure model latency and throughput")
+	fmt.Fprintln(os.Stderr, "  create-cache         Cache a large system instruction for use with generate --cached-content")
+	fmt.Fprintln(os.Stderr, "  update-cache         Extend or shorten the TTL of a cache")
+	fmt.Fprintln(os.Stderr, "  count-tokens         Count tokens per file for files, directories or globs")
+	fmt.Fprintln(os.Stderr, "  probe                Check the API key and connection to the API")
 	fmt.Fprintf(os.Stderr, "Run '%s <command> --help' for more information on a command.\n", os.Args[0])
 }
 
 type ParsedPart struct {
-	Type  string // "text" or "file"
+	Type  string // "text", "file" or "text-file"
 	Value string
+	// Optional label from "file:LABEL", sent as a text part before the file
+	Label string
+	// Set by resolveFileReferences when Value names an uploaded file
+	FileURI  string
+	MIMEType string
+	// Set by loadParts: the file or text-file part already read, for parts
+	// sent in many requests
+	Loaded *Part
 }
 
 func parseInputParts(args []string) ([]ParsedPart, error) {
@@ -156,32 +814,309 @@ func parseInputParts(args []string) ([]ParsedPart, error) {
 	for i := 0; i < len(args); i += 2 {
 		partType := args[i]
 		partValue := args[i+1]
-		if partType != "text" && partType != "file" {
-			return nil, fmt.Errorf("invalid part type: %s. Must be 'text' or 'file'", partType)
+		var label string
+		if strings.HasPrefix(partType, "file:") {
+			partType, label = "file", strings.TrimPrefix(partType, "file:")
+			if label == "" {
+				return nil, fmt.Errorf("empty label in part type 'file:'")
+			}
+		}
+		if partType != "text" && partType != "file" && partType != "text-file" {
+			return nil, fmt.Errorf("invalid part type: %s. Must be 'text', 'file', 'file:LABEL' or 'text-file'", partType)
 		}
-		parts = append(parts, ParsedPart{Type: partType, Value: partValue})
+		parts = append(parts, ParsedPart{Type: partType, Value: partValue, Label: label})
 	}
 	return parts, nil
 }
 
+// Helper struct to pass parsed CLI flags for part processing
+type PartsInput struct {
+	ConcatText               bool
+	ConcatSeparator          string
+	TrimParts                bool
+	StripImageMetadata       bool
+	DedupeParts              bool
+	CachedContent            string
+	TextEncoding             string
+	SystemInstructionFiles   []string
+	ReplaceSystemInstruction bool
+	CompactSystemInstruction string // "light", "full" or "" for off
+	ContinueLast             bool
+}
+
+// stringSliceFlag collects the values of a flag that may be repeated.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// wrapPrompt prepends prefix to the first text part and appends suffix to the
+// last one, separated by a newline. Without text parts they are added as
+// parts of their own at the start and end.
+func wrapPrompt(parts []ParsedPart, prefix, suffix string) []ParsedPart {
+	first, last := -1, -1
+	for i, p := range parts {
+		if p.Type == "text" {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if prefix != "" {
+		if first >= 0 {
+			parts[first].Value = prefix + "\n" + parts[first].Value
+		} else {
+			parts = append([]ParsedPart{{Type: "text", Value: prefix}}, parts...)
+			if last >= 0 {
+				last++
+			}
+		}
+	}
+	if suffix != "" {
+		if last >= 0 {
+			parts[last].Value = parts[last].Value + "\n" + suffix
+		} else {
+			parts = append(parts, ParsedPart{Type: "text", Value: suffix})
+		}
+	}
+	return parts
+}
+
+// Formats accepted by generate --format and default_output_format in config.
+var outputFormats = []string{"json", "text", "json-answer", "csv", "base64"}
+
+func isValidOutputFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// flagWasSet reports whether the named flag was given on the command line.
+func flagWasSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 // Helper struct to pass parsed CLI flags for GenerationConfig
 type GenerationConfigInput struct {
-	Temperature              float64
-	MaxOutputTokens          int
-	TopP                     float64
-	TopK                     int
-	StopSequence             string
-	ResponseMimeType         string
-	ResponseSchemaFileOrJSON string
-	ThinkingBudget           int
-	IncludeThoughts          bool
+	GenerationConfigFileOrJSON string
+	Temperature                float64
+	MaxOutputTokens            int
+	TopP                       float64
+	TopK                       int
+	StopSequence               string
+	ResponseMimeType           string
+	ResponseSchemaFileOrJSON   string
+	ResponseSchemaPatch        string // Shallow-merged over the schema
+	StrictSchema               bool
+	PropertyOrder              []string // Explicit propertyOrdering names, for --property-order
+	ResolveSchemaRefs          bool
+	PermissiveJSONSchema       bool // Any-object schema when none is given, for --json
+	ResponseEnum               []string
+	ThinkingBudget             int
+	IncludeThoughts            bool
 }
 
 // Helper struct to pass parsed CLI flags for Tools
 type ToolsInput struct {
+	FunctionDeclarationsFileOrJSON string
+	ToolHandler                    string
+	MaxToolTurns                   int
+	FunctionCallingMode            string
+	AllowedFunctions               string
 	EnableURLContext               bool
 	EnableGoogleSearch             bool
 	EnableGoogleSearchRetrieval    bool
 	GoogleSearchRetrievalMode      string
 	GoogleSearchRetrievalThreshold float64
 }
+
+// Helper struct to pass parsed CLI flags for Files API references
+type FilesInput struct {
+	AutoFileAPI     bool
+	WaitTimeout     time.Duration
+	UploadTimeout   time.Duration // 0 disables
+	InlineThreshold int64         // Bytes; 0 disables
+}
+
+// Helper struct to pass parsed CLI flags for rate limiting and retries
+type RetryInput struct {
+	TargetRPM        float64
+	MaxRetries       int
+	RetryNotFound    int
+	Timeout          time.Duration // Bounds all attempts together; 0 disables
+	RetryStatusCodes []int         // nil for the built-in set
+}
+
+// Helper struct to pass parsed CLI flags for output handling
+type OutputInput struct {
+	Format            string // "json", "text", "json-answer", "csv" or "base64"
+	SaveRequestOnly   bool
+	PrettyParts       bool // Print a readable preview instead of sending
+	FailIfEmptyText   bool
+	ExtractJSON       bool // Find the JSON in the answer text before json-answer formatting
+	FixtureName       string
+	FixtureDir        string
+	Verbose           bool
+	ShowRequestSize   bool
+	EchoPrompt        bool
+	ShowSafety        bool
+	DetailedUsage     bool
+	EstimateCost      bool
+	ThinkingWarnRatio float64
+	ShowRetries       bool
+	TranscriptPath    string
+	PrintPromptHash   bool
+	PromptHashFile    string
+	StripMarkdown     bool
+	Minify            bool
+	Template          *template.Template
+	RequireJSON       bool // Resend when the answer isn't valid JSON
+}
+
+// Helper struct to pass parsed CLI flags for --split-chunks
+type ChunkInput struct {
+	ChunkTokens  int
+	ChunkOverlap int
+}
+
+// Helper struct to pass parsed CLI flags for --parts-from-csv
+type CSVInput struct {
+	Path         string
+	PromptColumn string
+	AnswerColumn string
+	OutputPath   string
+	SummaryPath  string
+	PromptPrefix string // Applied per row, see wrapPrompt
+	PromptSuffix string
+}
+
+// Helper struct to pass parsed CLI flags for list-models
+type ListModelsInput struct {
+	Format   string // "json" or "table"
+	Sort     string
+	Reverse  bool
+	OnlyText bool
+	Short    bool
+}
+
+// Helper struct to pass parsed CLI flags for benchmark
+type BenchmarkInput struct {
+	Requests        int
+	Concurrency     int
+	MaxOutputTokens int
+}
+
+// Helper struct to pass parsed CLI flags for count-tokens
+type CountTokensInput struct {
+	Format            string // "table" or "json"
+	Concurrency       int
+	EstimateCost      bool
+	AbortOnFirstError bool
+	// Counted once, as a separate row, on top of the files
+	ResponseSchemaFileOrJSON       string
+	FunctionDeclarationsFileOrJSON string
+	CachedContent                  string // Counted separately from the files
+}
+
+// Helper struct to pass parsed CLI flags for TLS. Shared by every command that
+// talks to the network.
+type TLSInput struct {
+	CACertPath         string
+	InsecureSkipVerify bool
+}
+
+var tlsInput TLSInput
+
+func registerTLSFlags(fs *flag.FlagSet) {
+	fs.StringVar(&tlsInput.CACertPath, "ca-cert", "", "PEM file with extra CA certificates to trust, e.g. for a TLS-intercepting proxy (default: \"\")")
+	fs.BoolVar(&tlsInput.InsecureSkipVerify, "insecure-skip-verify", false, "Skip TLS certificate verification. Last resort only. (default: false)")
+}
+
+// Helper struct to pass parsed CLI flags for fetching http(s) file parts
+type FetchInput struct {
+	MaxRedirects      int
+	SameHostRedirects bool
+	BlockPrivateIPs   bool
+}
+
+var fetchInput FetchInput
+
+func registerFetchFlags(fs *flag.FlagSet) {
+	fs.IntVar(&fetchInput.MaxRedirects, "max-redirects", 5, "Maximum redirects followed when fetching http(s) file parts; 0 disables redirects")
+	fs.BoolVar(&fetchInput.SameHostRedirects, "same-host-redirects", false, "Only follow redirects that stay on the original host when fetching http(s) file parts (default: false)")
+	fs.BoolVar(&fetchInput.BlockPrivateIPs, "block-private-ips", false, "Refuse to fetch http(s) file parts from loopback, private or link-local addresses, including after redirects. Ignores proxy settings. (default: false)")
+}
+
+func registerAPIVersionFlags(fs *flag.FlagSet) {
+	fs.Func("api-version", "API version to call: v1 or v1beta. Some features, such as thinking and search tools, are only in v1beta. (default: v1beta)", func(value string) error {
+		if value != "v1" && value != "v1beta" {
+			return fmt.Errorf("must be v1 or v1beta")
+		}
+		apiVersion = value
+		return nil
+	})
+}
+
+// httpMethodOverride replaces the HTTP method of every API request the command
+// makes. It is a debugging aid for poking at new endpoints.
+var httpMethodOverride string
+
+func registerDebugFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&traceRequests, "trace", false, "Print DNS, connect, TLS, time-to-first-byte and total timings of each API request to stderr (default: false)")
+	fs.Func("http-method", "Debugging only: send every API request of this command with this HTTP method (e.g. PATCH). Requests the endpoint doesn't accept will fail. (default: per request)", func(value string) error {
+		if value == "" || strings.ToUpper(value) != value || strings.ContainsAny(value, " \t/") {
+			return fmt.Errorf("must be an uppercase HTTP method such as GET, POST or PATCH")
+		}
+		httpMethodOverride = value
+		return nil
+	})
+}
+
+// sniffMIME makes local files' MIME type come from their content when it
+// clearly contradicts the extension.
+var sniffMIME bool
+
+func registerSniffFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&sniffMIME, "sniff-mime", false, "Check local files' content against their extension and use the detected type, with a warning, when they disagree (e.g. a .txt that is a PNG) (default: false)")
+}
+
+func registerStoreFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&noStore, "no-store", false, "Don't read or write the config file or write any other file; the API key must come from "+envAPIKey+" (default: false)")
+}
+
+// refuseWithNoStore exits with a usage error if any of the named flags, which
+// write files, was given together with --no-store.
+func refuseWithNoStore(fs *flag.FlagSet, names ...string) {
+	if !noStore {
+		return
+	}
+	for _, name := range names {
+		if flagWasSet(fs, name) {
+			usageErrorf(fs, "Error: --%s writes to disk and can't be used with --no-store", name)
+		}
+	}
+}
+
+// assumeYes skips confirmation prompts for destructive commands.
+var assumeYes bool
+
+func registerConfirmFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&assumeYes, "yes", false, "Skip the confirmation prompt; required when not running on a terminal (default: false)")
+	fs.BoolVar(&assumeYes, "assume-yes", false, "Alias for --yes")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	mdHeading      = regexp.MustCompile(`^\s{0,3}#{1,6}\s+(.*?)\s*#*\s*$`)
+	mdRule         = regexp.MustCompile(`^\s{0,3}([-*_])(\s*[-*_]){2,}\s*$`)
+	mdBlockquote   = regexp.MustCompile(`^\s{0,3}>\s?`)
+	mdBullet       = regexp.MustCompile(`^(\s*)[*+-]\s+`)
+	mdTableDivider = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+	mdImage        = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLink         = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	mdCode         = regexp.MustCompile("`+([^`]+)`+")
+	mdStrong       = regexp.MustCompile(`(\*\*|__)(\S(?:.*?\S)?)(\*\*|__)`)
+	mdEmphasis     = regexp.MustCompile(`(^|[^\w*])[*_](\S(?:[^*_]*?\S)?)[*_]($|[^\w*])`)
+	mdStrike       = regexp.MustCompile(`~~(.+?)~~`)
+)
+
+// stripMarkdown converts a Markdown answer to plain text. Headings, emphasis,
+// code spans, links and table pipes are removed; fenced code keeps its content,
+// and list items stay one per line with "-" or their number as the marker.
+func stripMarkdown(text string) string {
+	var out []string
+	inFence := false
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			out = append(out, line)
+			continue
+		}
+		if mdRule.MatchString(line) || (strings.Contains(line, "|") && mdTableDivider.MatchString(line)) {
+			continue
+		}
+
+		line = mdBlockquote.ReplaceAllString(line, "")
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			line = m[1]
+		}
+		line = mdBullet.ReplaceAllString(line, "$1- ")
+		if strings.HasPrefix(strings.TrimSpace(line), "|") {
+			cells := strings.Split(strings.Trim(strings.TrimSpace(line), "|"), "|")
+			for i := range cells {
+				cells[i] = strings.TrimSpace(cells[i])
+			}
+			line = strings.Join(cells, "\t")
+		}
+		line = stripInlineMarkdown(line)
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+func stripInlineMarkdown(line string) string {
+	line = mdImage.ReplaceAllString(line, "$1")
+	line = mdLink.ReplaceAllString(line, "$1")
+	line = mdCode.ReplaceAllString(line, "$1")
+	line = mdStrong.ReplaceAllString(line, "$2")
+	line = mdEmphasis.ReplaceAllString(line, "$1$2$3")
+	line = mdStrike.ReplaceAllString(line, "$1")
+	return line
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ModelName is a model name split into its parts, e.g.
+// "models/gemini-2.5-flash-preview-05-20" is family "gemini", version "2.5",
+// variant "flash" and tag "preview-05-20".
+type ModelName struct {
+	Family  string // "gemini" or "gemma"
+	Version string // e.g. "1.5", "2.0", "2.5"
+	Variant string // e.g. "pro", "flash", "flash-lite", "flash-8b"; may be empty
+	Tag     string // Anything after the variant, e.g. "latest", "001", "preview-05-20"
+}
+
+var modelNamePattern = regexp.MustCompile(`^(gemini|gemma)-(\d+(?:\.\d+)?)(?:-(pro|flash-lite|flash-8b|flash|ultra|nano))?(?:-(.+))?$`)
+
+// parseModelName parses a model name with or without the "models/" prefix.
+// Unrecognized names yield a zero ModelName, so feature checks keyed on the
+// version are skipped for them.
+func parseModelName(modelName string) ModelName {
+	m := modelNamePattern.FindStringSubmatch(strings.TrimPrefix(modelName, "models/"))
+	if m == nil {
+		return ModelName{}
+	}
+	return ModelName{Family: m[1], Version: m[2], Variant: m[3], Tag: m[4]}
+}
+
+// versionAtLeast reports whether the model version is at least v. It is false
+// for unrecognized names.
+func (n ModelName) versionAtLeast(v float64) bool {
+	version, err := strconv.ParseFloat(n.Version, 64)
+	return err == nil && version >= v
+}
+
+// String renders the name for display, e.g. "Gemini 2.5 Flash (preview-05-20)".
+func (n ModelName) String() string {
+	if n.Family == "" {
+		return ""
+	}
+	words := []string{strings.ToUpper(n.Family[:1]) + n.Family[1:], n.Version}
+	for _, w := range strings.Split(n.Variant, "-") {
+		if w != "" {
+			words = append(words, strings.ToUpper(w[:1])+w[1:])
+		}
+	}
+	s := strings.Join(words, " ")
+	if n.Tag != "" {
+		s += " (" + n.Tag + ")"
+	}
+	return s
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestParseModelName(t *testing.T) {
+	tests := []struct {
+		name string
+		want ModelName
+	}{
+		{"gemini-1.5-flash-latest", ModelName{Family: "gemini", Version: "1.5", Variant: "flash", Tag: "latest"}},
+		{"gemini-2.5-pro-preview-05-06", ModelName{Family: "gemini", Version: "2.5", Variant: "pro", Tag: "preview-05-06"}},
+		{"gemini-1.5-pro-002", ModelName{Family: "gemini", Version: "1.5", Variant: "pro", Tag: "002"}},
+		{"gemini-2.0-flash-lite", ModelName{Family: "gemini", Version: "2.0", Variant: "flash-lite"}},
+		{"gemini-2.0-flash-lite-001", ModelName{Family: "gemini", Version: "2.0", Variant: "flash-lite", Tag: "001"}},
+		{"gemini-1.5-flash-8b", ModelName{Family: "gemini", Version: "1.5", Variant: "flash-8b"}},
+		{"models/gemini-2.5-flash", ModelName{Family: "gemini", Version: "2.5", Variant: "flash"}},
+		{"models/gemma-3-27b-it", ModelName{Family: "gemma", Version: "3", Tag: "27b-it"}},
+		{"gemini-2.0", ModelName{Family: "gemini", Version: "2.0"}},
+		{"text-embedding-004", ModelName{}},
+		{"models/imagen-3.0-generate-002", ModelName{}},
+		{"my-tuned-model", ModelName{}},
+		{"", ModelName{}},
+	}
+	for _, tt := range tests {
+		if got := parseModelName(tt.name); got != tt.want {
+			t.Errorf("parseModelName(%q) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
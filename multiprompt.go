@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// promptSeparator, given where a part type is expected, starts a new prompt:
+// "generate text 'q1' --- text 'q2'" runs two independent requests.
+const promptSeparator = "---"
+
+// splitPromptArgs splits the generate part arguments at each promptSeparator
+// in a part type position. A "---" given as a part value is left alone.
+func splitPromptArgs(args []string) ([][]string, error) {
+	groups := [][]string{nil}
+	for i := 0; i < len(args); i += 2 {
+		if args[i] == promptSeparator {
+			if len(groups[len(groups)-1]) == 0 {
+				return nil, fmt.Errorf("prompt %d is empty; put parts between the '%s' separators", len(groups), promptSeparator)
+			}
+			groups = append(groups, nil)
+			i-- // The separator is a single argument
+			continue
+		}
+		end := min(i+2, len(args))
+		groups[len(groups)-1] = append(groups[len(groups)-1], args[i:end]...)
+	}
+	if len(groups) > 1 && len(groups[len(groups)-1]) == 0 {
+		return nil, fmt.Errorf("prompt %d is empty; remove the trailing '%s'", len(groups), promptSeparator)
+	}
+	return groups, nil
+}
+
+// handleMultiPromptGenerate sends each prompt as its own generate request, in
+// order, with the same model and settings and no shared context. Answers are
+// printed in order with a promptSeparator line between them; a failed prompt
+// leaves its slot empty. Without keepGoing the first failure ends the run.
+func handleMultiPromptGenerate(run *generateRun, prompts [][]ParsedPart, keepGoing bool) {
+	var failed []string
+	for i, parts := range prompts {
+		if i > 0 {
+			fmt.Println(promptSeparator)
+		}
+		err := resolveFileReferences(run.config.APIKey, parts, run.filesInput.WaitTimeout)
+		var output string
+		if err == nil {
+			output, err = generatePromptOutput(run, parts)
+		}
+		if err != nil {
+			if !keepGoing {
+				fatalf("Error: prompt %d of %d: %v", i+1, len(prompts), err)
+			}
+			fmt.Fprintf(errorOutput, "Error: prompt %d of %d: %v\n", i+1, len(prompts), err)
+			failed = append(failed, strconv.Itoa(i+1))
+			continue
+		}
+		fmt.Println(output)
+	}
+
+	run.printSummary()
+	if len(failed) > 0 {
+		fatalf("%d of %d prompt(s) failed (prompts: %s)", len(failed), len(prompts), strings.Join(failed, ", "))
+	}
+}
+
+// generatePromptOutput sends one prompt of a multi-prompt run and returns
+// what --format asks to print for it.
+func generatePromptOutput(run *generateRun, parts []ParsedPart) (string, error) {
+	requestPayload, err := run.buildRequest(run.systemInstructionStr, parts, run.genConfigInput)
+	if err != nil {
+		return "", fmt.Errorf("failed to build request: %w", err)
+	}
+	response, responseBody, err := run.send(requestPayload)
+	if err != nil {
+		return "", err
+	}
+	outputInput := run.outputInput
+	if outputInput.FailIfEmptyText {
+		if err := response.requireText(); err != nil {
+			return "", err
+		}
+	}
+	switch outputInput.Format {
+	case "text":
+		if outputInput.StripMarkdown {
+			return stripMarkdown(response.Text()), nil
+		}
+		return response.Text(), nil
+	case "json-answer":
+		text := response.Text()
+		if outputInput.ExtractJSON {
+			if text, err = extractJSON(text); err != nil {
+				return "", err
+			}
+		}
+		return formatJSONAnswer(text, outputInput.Minify)
+	}
+	if outputInput.Minify {
+		responseBody = minifyJSON(responseBody)
+	}
+	return string(responseBody), nil
+}
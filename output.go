@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+)
+
+// formatPromptEcho renders the text parts of the system instruction and the
+// new user turn verbatim and summarizes non-text parts on a single line each.
+func formatPromptEcho(systemInstruction *SystemInstruction, prompt Content) string {
+	var sb strings.Builder
+	sb.WriteString("--- Prompt ---\n")
+	if systemInstruction != nil {
+		for _, p := range systemInstruction.Parts {
+			sb.WriteString("[system] ")
+			writePartSummary(&sb, p)
+		}
+	}
+	for _, p := range prompt.Parts {
+		writePartSummary(&sb, p)
+	}
+	sb.WriteString("--- Response ---")
+	return sb.String()
+}
+
+func writePartSummary(sb *strings.Builder, p Part) {
+	switch {
+	case p.Text != nil:
+		sb.WriteString(*p.Text)
+		sb.WriteString("\n")
+	case p.InlineData != nil:
+		size := base64.StdEncoding.DecodedLen(len(p.InlineData.Data))
+		fmt.Fprintf(sb, "[inline_data: %s, ~%d bytes]\n", p.InlineData.MIMEType, size)
+	case p.FileData != nil:
+		fmt.Fprintf(sb, "[file_data: %s, %s]\n", p.FileData.MIMEType, p.FileData.FileURI)
+	case p.FunctionCall != nil:
+		fmt.Fprintf(sb, "[function_call: %s %s]\n", p.FunctionCall.Name, string(p.FunctionCall.Args))
+	case p.FunctionResponse != nil:
+		fmt.Fprintf(sb, "[function_response: %s %s]\n", p.FunctionResponse.Name, string(p.FunctionResponse.Response))
+	}
+}
+
+// formatRequestPreview renders a request for reading before it is sent: text
+// wrapped, file parts as "[file: name, mime type, size]", then the effective
+// generation config, tools and safety settings. fileNames are the sources of
+// the prompt's file parts, in order; when they don't line up with the parts
+// (e.g. after --dedupe-parts) inline parts are just called "inline data".
+func formatRequestPreview(modelName string, req *GenerateContentRequest, fileNames []string) string {
+	const width = 76
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Model: %s\n", strings.TrimPrefix(modelName, "models/"))
+	if req.CachedContent != "" {
+		fmt.Fprintf(&sb, "Cached content: %s\n", req.CachedContent)
+	}
+	if req.SystemInstruction != nil {
+		sb.WriteString("\nSystem instruction:\n")
+		writePreviewParts(&sb, req.SystemInstruction.Parts, nil, width)
+	}
+	for i, content := range req.Contents {
+		switch {
+		case len(req.Contents) == 1:
+			sb.WriteString("\nPrompt:\n")
+		case content.Role != "":
+			fmt.Fprintf(&sb, "\nTurn %d (%s):\n", i+1, content.Role)
+		default:
+			fmt.Fprintf(&sb, "\nTurn %d:\n", i+1)
+		}
+		var names []string
+		if i == len(req.Contents)-1 {
+			names = fileNames
+		}
+		writePreviewParts(&sb, content.Parts, names, width)
+	}
+
+	if req.GenerationConfig != nil {
+		sb.WriteString("\nGeneration config:\n")
+		data, _ := json.Marshal(req.GenerationConfig)
+		if obj, err := parseOrderedObject(data); err == nil {
+			for _, key := range obj.keys {
+				fmt.Fprintf(&sb, "  %s: %s\n", key, obj.values[key])
+			}
+		}
+	}
+	if len(req.Tools) > 0 {
+		var tools []string
+		for _, tool := range req.Tools {
+			if tool.FunctionDeclarations != nil {
+				var declarations []json.RawMessage
+				json.Unmarshal(tool.FunctionDeclarations, &declarations)
+				tools = append(tools, fmt.Sprintf("functionDeclarations (%d)", len(declarations)))
+				continue
+			}
+			data, _ := json.Marshal(tool)
+			if obj, err := parseOrderedObject(data); err == nil {
+				tools = append(tools, obj.keys...)
+			}
+		}
+		fmt.Fprintf(&sb, "\nTools: %s\n", strings.Join(tools, ", "))
+	}
+	if len(req.SafetySettings) > 0 {
+		settings := make([]string, len(req.SafetySettings))
+		for i, s := range req.SafetySettings {
+			settings[i] = s.Category + "=" + s.Threshold
+		}
+		fmt.Fprintf(&sb, "\nSafety settings: %s\n", strings.Join(settings, ", "))
+	}
+	return sb.String()
+}
+
+func writePreviewParts(sb *strings.Builder, parts []Part, fileNames []string, width int) {
+	fileParts := 0
+	for _, p := range parts {
+		if p.InlineData != nil || p.FileData != nil {
+			fileParts++
+		}
+	}
+	if fileParts != len(fileNames) {
+		fileNames = nil
+	}
+	n := 0
+	for _, p := range parts {
+		switch {
+		case p.Text != nil:
+			sb.WriteString(wrapText(*p.Text, "  ", width))
+		case p.InlineData != nil:
+			name := "inline data"
+			if fileNames != nil {
+				name = fileNames[n]
+			}
+			size := int64(base64.StdEncoding.DecodedLen(len(p.InlineData.Data)) - strings.Count(p.InlineData.Data, "="))
+			fmt.Fprintf(sb, "  [file: %s, %s, %s]\n", name, p.InlineData.MIMEType, formatByteSize(size))
+			n++
+		case p.FileData != nil:
+			fmt.Fprintf(sb, "  [file: %s, %s, uploaded]\n", p.FileData.FileURI, p.FileData.MIMEType)
+			n++
+		default:
+			sb.WriteString("  ")
+			writePartSummary(sb, p)
+		}
+	}
+}
+
+// previewFileNames returns how each file part was given, for
+// formatRequestPreview.
+func previewFileNames(parts []ParsedPart) []string {
+	var names []string
+	for _, p := range parts {
+		if p.Type != "file" {
+			continue
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(p.Value, "@"), "file://")
+		if strings.HasPrefix(name, "data:") {
+			name = "data URI"
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// appendTranscript appends one prompt/response exchange to a Markdown
+// transcript. The entry is written with a single append and synced, so
+// concurrent runs don't interleave within an entry.
+func appendTranscript(path, modelName string, promptParts []Part, answer string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "## %s · %s\n\n", time.Now().Format(time.RFC3339), strings.TrimPrefix(modelName, "models/"))
+	sb.WriteString("**Prompt**\n\n")
+	for _, p := range promptParts {
+		writePartSummary(&sb, p)
+	}
+	sb.WriteString("\n**Response**\n\n")
+	sb.WriteString(strings.TrimRight(answer, "\n"))
+	sb.WriteString("\n\n")
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open transcript '%s': %w", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(sb.String()); err != nil {
+		return fmt.Errorf("failed to write transcript '%s': %w", path, err)
+	}
+	return f.Sync()
+}
+
+// formatJSONAnswer parses the model's text answer as JSON and re-indents it,
+// or compacts it onto one line if minify is set.
+func formatJSONAnswer(text string, minify bool) (string, error) {
+	var buf bytes.Buffer
+	var err error
+	if minify {
+		err = json.Compact(&buf, []byte(strings.TrimSpace(text)))
+	} else {
+		err = json.Indent(&buf, []byte(strings.TrimSpace(text)), "", "  ")
+	}
+	if err != nil {
+		return "", fmt.Errorf("model answer is not valid JSON: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// jsonFence matches a Markdown code block, capturing its language tag and
+// contents.
+var jsonFence = regexp.MustCompile("(?s)```([A-Za-z0-9]*)[ \t]*\n(.*?)```")
+
+// extractJSON returns the first JSON object or array in an answer that
+// wasn't produced in JSON mode: preferably the contents of a ```json (or
+// untagged) fence, otherwise the first value starting at a '{' or '[' in the
+// text, ignoring any prose around it.
+func extractJSON(text string) (string, error) {
+	for _, match := range jsonFence.FindAllStringSubmatch(text, -1) {
+		lang, body := strings.ToLower(match[1]), strings.TrimSpace(match[2])
+		if (lang == "json" || lang == "") && isJSONContainer(body) {
+			return body, nil
+		}
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] != '{' && text[i] != '[' {
+			continue
+		}
+		var value json.RawMessage
+		if err := json.NewDecoder(strings.NewReader(text[i:])).Decode(&value); err == nil {
+			return string(value), nil
+		}
+	}
+	return "", fmt.Errorf("no JSON object or array found in the answer (--extract-json)")
+}
+
+// isJSONContainer reports whether s is a single valid JSON object or array.
+func isJSONContainer(s string) bool {
+	return (strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[")) && json.Valid([]byte(s))
+}
+
+// templateData is what --output-template templates can reference.
+type templateData struct {
+	Text         string
+	Model        string
+	FinishReason string
+	Usage        *UsageMetadata
+	Response     *GenerateContentResponse
+}
+
+// renderOutputTemplate executes tmpl against the response, ending the output
+// with a newline.
+func renderOutputTemplate(w io.Writer, tmpl *template.Template, modelName string, response *GenerateContentResponse) error {
+	data := templateData{
+		Text:     response.Text(),
+		Model:    strings.TrimPrefix(modelName, "models/"),
+		Usage:    response.UsageMetadata,
+		Response: response,
+	}
+	if len(response.Candidates) > 0 {
+		data.FinishReason = response.Candidates[0].FinishReason
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to render output template: %w", err)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// minifyJSON compacts data onto one line, returning it unchanged if it is not
+// valid JSON.
+func minifyJSON(data []byte) []byte {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// writeInlineDataBase64 prints each inlineData part of the first candidate as
+// its MIME type, a tab and its base64 data, one part per line, leaving the
+// data encoded for piping into other tools.
+func writeInlineDataBase64(w io.Writer, response *GenerateContentResponse) error {
+	if len(response.Candidates) == 0 {
+		return fmt.Errorf("response has no candidates")
+	}
+	n := 0
+	for _, p := range response.Candidates[0].Content.Parts {
+		if p.InlineData == nil {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", p.InlineData.MIMEType, p.InlineData.Data); err != nil {
+			return err
+		}
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("response has no inlineData parts")
+	}
+	return nil
+}
+
+// writeCSV converts a JSON array of objects into CSV with a header row.
+// Nested objects are flattened into dotted column names and arrays are written
+// as compact JSON. Columns appear in the order keys are first seen.
+func writeCSV(w io.Writer, jsonText string) error {
+	dec := json.NewDecoder(strings.NewReader(jsonText))
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("response must be a JSON array of objects for CSV output")
+	}
+
+	var header []string
+	seen := map[string]bool{}
+	var rows []map[string]string
+	for i := 0; dec.More(); i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("failed to decode array element %d: %w", i, err)
+		}
+		elemDec := json.NewDecoder(bytes.NewReader(raw))
+		elemDec.UseNumber()
+		var fields []csvField
+		if err := flattenJSONValue(elemDec, "", &fields); err != nil {
+			return fmt.Errorf("failed to flatten array element %d: %w", i, err)
+		}
+		if len(fields) == 1 && fields[0].Name == "" {
+			return fmt.Errorf("array element %d is not an object", i)
+		}
+		row := make(map[string]string, len(fields))
+		for _, f := range fields {
+			if !seen[f.Name] {
+				seen[f.Name] = true
+				header = append(header, f.Name)
+			}
+			row[f.Name] = f.Value
+		}
+		rows = append(rows, row)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := make([]string, len(header))
+		for i, name := range header {
+			record[i] = row[name]
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+type csvField struct {
+	Name  string
+	Value string
+}
+
+func flattenJSONValue(dec *json.Decoder, prefix string, out *[]csvField) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				name := keyTok.(string)
+				if prefix != "" {
+					name = prefix + "." + name
+				}
+				if err := flattenJSONValue(dec, name, out); err != nil {
+					return err
+				}
+			}
+			_, err := dec.Token() // closing '}'
+			return err
+		}
+		// Arrays are kept as compact JSON in a single cell
+		var elems []json.RawMessage
+		for dec.More() {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+			elems = append(elems, raw)
+		}
+		if _, err := dec.Token(); err != nil { // closing ']'
+			return err
+		}
+		if elems == nil {
+			elems = []json.RawMessage{}
+		}
+		data, err := json.Marshal(elems)
+		if err != nil {
+			return err
+		}
+		*out = append(*out, csvField{Name: prefix, Value: string(data)})
+	case string:
+		*out = append(*out, csvField{Name: prefix, Value: t})
+	case json.Number:
+		*out = append(*out, csvField{Name: prefix, Value: t.String()})
+	case bool:
+		*out = append(*out, csvField{Name: prefix, Value: fmt.Sprintf("%t", t)})
+	case nil:
+		*out = append(*out, csvField{Name: prefix, Value: ""})
+	}
+	return nil
+}
+
+// formatUsage renders the token counts, with a per-modality breakdown when the
+// response includes one.
+func formatUsage(usage *UsageMetadata) string {
+	if usage == nil {
+		return "Usage: response has no usageMetadata"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Usage: prompt %d, candidates %d, thoughts %d, cached %d, total %d",
+		usage.PromptTokenCount, usage.CandidatesTokenCount, usage.ThoughtsTokenCount,
+		usage.CachedContentTokenCount, usage.TotalTokenCount)
+	writeModalityBreakdown(&sb, "Prompt", usage.PromptTokensDetails)
+	writeModalityBreakdown(&sb, "Candidates", usage.CandidatesTokensDetails)
+	return sb.String()
+}
+
+func writeModalityBreakdown(sb *strings.Builder, label string, details []ModalityTokenCount) {
+	if len(details) == 0 {
+		return
+	}
+	fmt.Fprintf(sb, "\n  %s by modality:", label)
+	for _, d := range details {
+		fmt.Fprintf(sb, "\n    %s: %d", d.Modality, d.TokenCount)
+	}
+}
+
+// formatSafetyRatings lists each candidate's ratings as "category: probability".
+func formatSafetyRatings(candidates []Candidate) string {
+	var sb strings.Builder
+	sb.WriteString("Safety ratings:")
+	if len(candidates) == 0 {
+		sb.WriteString(" none (no candidates)")
+	}
+	for _, c := range candidates {
+		if len(candidates) > 1 {
+			fmt.Fprintf(&sb, "\n  Candidate %d:", c.Index)
+		}
+		if len(c.SafetyRatings) == 0 {
+			sb.WriteString("\n  (none reported)")
+		}
+		for _, r := range c.SafetyRatings {
+			fmt.Fprintf(&sb, "\n  %s: %s", r.Category, r.Probability)
+			if r.Blocked {
+				sb.WriteString(" (blocked)")
+			}
+		}
+	}
+	return sb.String()
+}
+
+// saveRequestFixture writes the request, pretty-printed with a trailing
+// newline, to dir/name.json without sending it.
+func saveRequestFixture(req *GenerateContentRequest, dir, name string) (string, error) {
+	data, err := json.MarshalIndent(req, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create fixture directory %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, name+".json")
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("failed to write fixture %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// Short names for the generation methods shown in the model table.
+var methodAbbreviations = map[string]string{
+	"generateContent":       "gen",
+	"streamGenerateContent": "stream",
+	"countTokens":           "count",
+	"createCachedContent":   "cache",
+	"embedContent":          "embed",
+	"batchEmbedContents":    "batchEmbed",
+	"batchGenerateContent":  "batchGen",
+	"bidiGenerateContent":   "live",
+	"predict":               "predict",
+	"predictLongRunning":    "predictLR",
+}
+
+func abbreviateMethods(methods []string) string {
+	short := make([]string, len(methods))
+	for i, m := range methods {
+		if a, ok := methodAbbreviations[m]; ok {
+			short[i] = a
+		} else {
+			short[i] = m
+		}
+	}
+	return strings.Join(short, ",")
+}
+
+// truncate shortens s to at most max runes, marking the cut with "~".
+func truncate(s string, max int) string {
+	r := []rune(s)
+	if max <= 0 || len(r) <= max {
+		return s
+	}
+	if max == 1 {
+		return "~"
+	}
+	return string(r[:max-1]) + "~"
+}
+
+// writeModelTable prints the models as an aligned table that fits in width
+// columns, truncating the name, display name and methods fields as needed.
+func writeModelTable(w io.Writer, models []ModelOutputInfo, width int) {
+	const (
+		numbersWidth = 2*9 + 4*2 // INPUT and OUTPUT columns plus padding
+		minField     = 8
+	)
+	nameMax, displayMax := 40, 28
+	methodsMax := width - nameMax - displayMax - numbersWidth
+	if methodsMax < minField {
+		// Shrink the text columns proportionally on narrow terminals
+		avail := width - numbersWidth - minField
+		if avail < 2*minField {
+			avail = 2 * minField
+		}
+		nameMax = avail * 4 / 7
+		displayMax = avail - nameMax
+		methodsMax = minField
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tDISPLAY NAME\tINPUT\tOUTPUT\tMETHODS")
+	for _, m := range models {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n",
+			truncate(strings.TrimPrefix(m.Name, "models/"), nameMax),
+			truncate(m.DisplayName, displayMax),
+			m.InputTokenLimit,
+			m.OutputTokenLimit,
+			truncate(abbreviateMethods(m.SupportedGenerationMethods), methodsMax))
+	}
+	tw.Flush()
+}
+
+// thinkingCostWarning returns a warning when thinking tokens exceed ratio times
+// the answer tokens, or "" if not.
+func thinkingCostWarning(usage *UsageMetadata, ratio float64) string {
+	if usage == nil || ratio <= 0 || usage.ThoughtsTokenCount == 0 {
+		return ""
+	}
+	if float64(usage.ThoughtsTokenCount) <= ratio*float64(usage.CandidatesTokenCount) {
+		return ""
+	}
+	return fmt.Sprintf("Warning: thinking used %d tokens for a %d token answer (over %.1fx). Thinking is billed as output; consider a lower --thinking-budget. Silence with --thinking-warn-ratio 0.",
+		usage.ThoughtsTokenCount, usage.CandidatesTokenCount, ratio)
+}
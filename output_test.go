@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteInlineDataBase64(t *testing.T) {
+	const body = `{"candidates": [{"content": {"role": "model", "parts": [
+		{"text": "Here is the chart:"},
+		{"inlineData": {"mimeType": "image/png", "data": "iVBORw0KGgo="}},
+		{"text": "and the narration:"},
+		{"inlineData": {"mimeType": "audio/wav", "data": "UklGRiQAAABXQVZF"}}
+	]}}]}`
+	var response GenerateContentResponse
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := writeInlineDataBase64(&out, &response); err != nil {
+		t.Fatalf("writeInlineDataBase64: %v", err)
+	}
+	want := "image/png\tiVBORw0KGgo=\naudio/wav\tUklGRiQAAABXQVZF\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWriteInlineDataBase64NoInlineData(t *testing.T) {
+	response := GenerateContentResponse{Candidates: []Candidate{{Content: ResponseContent{Parts: []ResponsePart{{Text: "only text"}}}}}}
+	if err := writeInlineDataBase64(&bytes.Buffer{}, &response); err == nil {
+		t.Error("writeInlineDataBase64 accepted a response without inlineData parts")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// generateRun holds what every request of one generate invocation shares: the
+// settings from flags and config, the retry statistics, the prompt hashes
+// written so far and the token usage summed for --estimate-cost. A single
+// request, --split-chunks, --parts-from-csv and several prompts are all built
+// and sent through it, so the same flags apply to each.
+type generateRun struct {
+	config               *Config
+	modelName            string // With the "models/" prefix
+	systemInstructionStr string
+	partsInput           PartsInput
+	genConfigInput       GenerationConfigInput
+	toolsInput           ToolsInput
+	safetySettingsStr    string
+	cassetteInput        CassetteInput
+	filesInput           FilesInput
+	retryInput           RetryInput
+	outputInput          OutputInput
+
+	stats        retryStats
+	usage        *UsageMetadata // Nil until a response reports usage
+	promptHashes []string
+	warnedV1     bool
+}
+
+func newGenerateRun(
+	config *Config,
+	modelName,
+	systemInstructionStr string,
+	partsInput PartsInput,
+	genConfigInput GenerationConfigInput,
+	toolsInput ToolsInput,
+	safetySettingsStr string,
+	cassetteInput CassetteInput,
+	filesInput FilesInput,
+	retryInput RetryInput,
+	outputInput OutputInput) *generateRun {
+
+	if !strings.HasPrefix(modelName, "models/") {
+		modelName = "models/" + modelName
+	}
+	return &generateRun{
+		config:               config,
+		modelName:            modelName,
+		systemInstructionStr: systemInstructionStr,
+		partsInput:           partsInput,
+		genConfigInput:       genConfigInput,
+		toolsInput:           toolsInput,
+		safetySettingsStr:    safetySettingsStr,
+		cassetteInput:        cassetteInput,
+		filesInput:           filesInput,
+		retryInput:           retryInput,
+		outputInput:          outputInput,
+	}
+}
+
+// loadParts resolves uploaded file references and reads each file and
+// text-file part once, so that building a request per chunk, row or prompt
+// doesn't read or download them again.
+func (r *generateRun) loadParts(parts []ParsedPart) error {
+	if err := resolveFileReferences(r.config.APIKey, parts, r.filesInput.WaitTimeout); err != nil {
+		return err
+	}
+	for i := range parts {
+		if err := loadPart(&parts[i], r.partsInput); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPart reads a file or text-file part into p.Loaded, unless it is already
+// loaded or names an uploaded file.
+func loadPart(p *ParsedPart, partsInput PartsInput) error {
+	if p.Loaded != nil {
+		return nil
+	}
+	switch {
+	case p.Type == "text-file":
+		text, err := readTextFilePart(p.Value, partsInput)
+		if err != nil {
+			return err
+		}
+		p.Loaded = &Part{Text: &text}
+	case p.Type == "file" && p.FileURI == "":
+		part, err := buildInlineFilePart(p.Value, partsInput)
+		if err != nil {
+			return err
+		}
+		p.Loaded = &part
+	}
+	return nil
+}
+
+// buildRequest builds the request for parts and applies the request-level
+// flags: --dedupe-parts, --cached-content, --continue-last and the prompt hash
+// flags. The system instruction and generation settings are given per call,
+// since --parts-from-csv rows may override them.
+func (r *generateRun) buildRequest(systemInstructionStr string, parts []ParsedPart, genConfigInput GenerationConfigInput) (*GenerateContentRequest, error) {
+	systemInstructions := mergeSystemInstructions(r.config.SystemInstruction, systemInstructionStr, r.partsInput.ReplaceSystemInstruction)
+	if r.partsInput.CompactSystemInstruction != "" {
+		systemInstructions = compactSystemInstructions(systemInstructions, r.partsInput.CompactSystemInstruction, r.outputInput.Verbose)
+	}
+	if r.partsInput.CachedContent != "" {
+		// The cache supplies the system instruction; the API rejects both.
+		systemInstructions = nil
+	}
+
+	if r.partsInput.DedupeParts {
+		var removed int
+		var err error
+		if parts, removed, err = dedupeParts(parts, r.partsInput); err != nil {
+			return nil, fmt.Errorf("failed to deduplicate parts: %w", err)
+		}
+		if removed > 0 {
+			fmt.Fprintf(os.Stderr, "Removed %d duplicate part(s)\n", removed)
+		}
+	}
+
+	req, err := buildGenerateContentRequest(systemInstructions, parts, r.partsInput, genConfigInput, r.toolsInput, r.safetySettingsStr, r.config.SafetySettings)
+	if err != nil {
+		return nil, err
+	}
+	if r.partsInput.CachedContent != "" {
+		req.CachedContent = cachedContentName(r.partsInput.CachedContent)
+	}
+
+	if apiVersion == "v1" && !r.warnedV1 {
+		if features := v1betaOnlyFeatures(req); len(features) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %s may not be available in API v1; use --api-version v1beta if the request is rejected\n", strings.Join(features, ", "))
+			r.warnedV1 = true
+		}
+	}
+
+	if len(req.Contents) == 0 && req.SystemInstruction == nil {
+		return nil, fmt.Errorf("request must contain 'contents' or 'system_instruction'")
+	}
+
+	if r.partsInput.ContinueLast {
+		last, err := loadLastExchange()
+		if err != nil {
+			return nil, fmt.Errorf("--continue-last: %w", err)
+		}
+		if r.outputInput.Verbose {
+			fmt.Fprintf(os.Stderr, "Continuing the exchange with %s from %s\n", last.Model, last.SavedAt.Local().Format(time.DateTime))
+		}
+		if len(req.Contents) > 0 {
+			req.Contents[0].Role = "user"
+		}
+		req.Contents = append([]Content{last.Prompt, last.Answer}, req.Contents...)
+	}
+
+	if err := r.notePromptHash(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// notePromptHash handles --print-prompt-hash and --prompt-hash-file for req.
+// With several requests the file holds one hash per line, in request order.
+func (r *generateRun) notePromptHash(req *GenerateContentRequest) error {
+	if !r.outputInput.PrintPromptHash && r.outputInput.PromptHashFile == "" {
+		return nil
+	}
+	hash, err := promptHash(r.modelName, req)
+	if err != nil {
+		return fmt.Errorf("failed to hash request: %w", err)
+	}
+	if r.outputInput.PrintPromptHash {
+		fmt.Fprintf(os.Stderr, "Prompt hash: %s\n", hash)
+	}
+	if r.outputInput.PromptHashFile != "" {
+		r.promptHashes = append(r.promptHashes, hash)
+		if err := os.WriteFile(r.outputInput.PromptHashFile, []byte(strings.Join(r.promptHashes, "\n")+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to write prompt hash: %w", err)
+		}
+	}
+	return nil
+}
+
+// send sends req and returns the final response, after any --json retries and
+// --tool-handler turns, and appends the exchange to the --transcript.
+func (r *generateRun) send(req *GenerateContentRequest) (*GenerateContentResponse, []byte, error) {
+	apiKey := r.config.APIKey
+
+	// Cassettes are keyed by the request before any part is moved to the
+	// Files API: uploads get a new file URI every run, so keys taken after
+	// them would never match on replay.
+	var cassettePayload *GenerateContentRequest
+	if r.cassetteInput.RecordPath != "" || r.cassetteInput.ReplayPath != "" {
+		var err error
+		if cassettePayload, err = cloneRequest(req); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// A replay has nothing to upload for when the cassette has the answer.
+	if r.filesInput.InlineThreshold > 0 && r.cassetteInput.ReplayPath == "" {
+		if err := applyInlineThreshold(apiKey, req, r.filesInput, r.outputInput.Verbose); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := enforceInlineLimit(apiKey, req, r.filesInput, r.outputInput.Verbose); err != nil {
+		return nil, nil, err
+	}
+
+	var promptParts []Part
+	if len(req.Contents) > 0 {
+		promptParts = req.Contents[len(req.Contents)-1].Parts
+	}
+
+	var response GenerateContentResponse
+	var responseBody []byte
+	for turn := 0; ; turn++ {
+		for attempt := 0; ; attempt++ {
+			var err error
+			responseBody, err = r.sendGenerateContent(req, cassettePayload)
+			if err != nil {
+				return nil, nil, err
+			}
+			response = GenerateContentResponse{}
+			if err := json.Unmarshal(responseBody, &response); err != nil {
+				return nil, nil, fmt.Errorf("failed to parse API response: %w", err)
+			}
+			r.addUsage(response.UsageMetadata)
+			if !r.outputInput.RequireJSON || len(response.FunctionCalls()) > 0 || json.Valid([]byte(strings.TrimSpace(response.Text()))) {
+				break
+			}
+			if attempt == maxJSONAnswerRetries {
+				return nil, nil, fmt.Errorf("model answer is still not valid JSON after %d attempts (--json)", attempt+1)
+			}
+			fmt.Fprintln(os.Stderr, "Answer is not valid JSON, retrying (--json)...")
+		}
+
+		calls := response.FunctionCalls()
+		if r.toolsInput.ToolHandler == "" || len(calls) == 0 {
+			break
+		}
+		if turn >= r.toolsInput.MaxToolTurns {
+			return nil, nil, fmt.Errorf("model still requesting function calls after %d tool turns", r.toolsInput.MaxToolTurns)
+		}
+		if r.outputInput.Verbose {
+			fmt.Fprintf(os.Stderr, "Running tool handler for %d function call(s)\n", len(calls))
+		}
+		responseParts, err := runToolHandler(r.toolsInput.ToolHandler, calls)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, turnReq := range []*GenerateContentRequest{req, cassettePayload} {
+			if turnReq == nil {
+				continue
+			}
+			if len(turnReq.Contents) > 0 && turnReq.Contents[0].Role == "" {
+				turnReq.Contents[0].Role = "user"
+			}
+			turnReq.Contents = append(turnReq.Contents, response.modelTurn(), Content{Role: "user", Parts: responseParts})
+		}
+	}
+
+	if r.outputInput.TranscriptPath != "" {
+		if err := appendTranscript(r.outputInput.TranscriptPath, r.modelName, promptParts, response.Text()); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+	return &response, responseBody, nil
+}
+
+// maxJSONAnswerRetries is how many times --json resends a request whose answer
+// isn't valid JSON.
+const maxJSONAnswerRetries = 2
+
+// sendGenerateContent sends one generateContent request, honoring replay,
+// record and throttle options, and returns the raw response body. The
+// cassette key is the hash of cassettePayload, the request as it was before
+// parts were uploaded, or of req if that is nil.
+func (r *generateRun) sendGenerateContent(req, cassettePayload *GenerateContentRequest) ([]byte, error) {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	if r.outputInput.Verbose || r.outputInput.ShowRequestSize {
+		fmt.Fprintf(os.Stderr, "Request size: %d bytes (%.2f MB)\n", len(jsonData), float64(len(jsonData))/(1024*1024))
+	}
+	if len(jsonData) > maxInlineRequestBytes*8/10 {
+		fmt.Fprintf(os.Stderr, "Warning: request is %.2f MB, close to or over the %d MB limit. Consider uploading large files with upload-file.\n",
+			float64(len(jsonData))/(1024*1024), maxInlineRequestBytes/(1024*1024))
+	}
+
+	endpoint := fmt.Sprintf("/%s:generateContent", r.modelName)
+	cassetteKey := requestHash(endpoint, jsonData)
+	if cassettePayload != nil {
+		keyData, err := json.Marshal(cassettePayload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		cassetteKey = requestHash(endpoint, keyData)
+	}
+
+	if r.cassetteInput.ReplayPath != "" {
+		responseBody, replayed, err := replayResponse(r.cassetteInput.ReplayPath, cassetteKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read replay cassette: %w", err)
+		}
+		if replayed {
+			return responseBody, nil
+		}
+	}
+
+	responseBody, err := postWithRetry(r.config.APIKey, endpoint, jsonData, r.retryInput, &r.stats)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.cassetteInput.RecordPath != "" {
+		if err := recordResponse(r.cassetteInput.RecordPath, cassetteKey, r.modelName, endpoint, responseBody); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to record response: %v\n", err)
+		}
+	}
+	return responseBody, nil
+}
+
+// addUsage adds usage to the run's total for --estimate-cost.
+func (r *generateRun) addUsage(usage *UsageMetadata) {
+	if usage == nil {
+		return
+	}
+	if r.usage == nil {
+		r.usage = &UsageMetadata{}
+	}
+	r.usage.PromptTokenCount += usage.PromptTokenCount
+	r.usage.CandidatesTokenCount += usage.CandidatesTokenCount
+	r.usage.ThoughtsTokenCount += usage.ThoughtsTokenCount
+	r.usage.CachedContentTokenCount += usage.CachedContentTokenCount
+	r.usage.TotalTokenCount += usage.TotalTokenCount
+}
+
+// printSummary prints the reports that cover the whole run: --estimate-cost
+// over every response and --show-retries.
+func (r *generateRun) printSummary() {
+	if r.outputInput.EstimateCost {
+		printCostEstimate(r.modelName, r.usage, r.config.Pricing)
+	}
+	if r.outputInput.ShowRetries {
+		fmt.Fprintln(os.Stderr, r.stats.summary())
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// needsPreflight reports whether the command line asks for a feature that
+// preflightModel checks against the model. Without one the model lookup is
+// skipped: a missing model fails the generate call just as clearly.
+func needsPreflight(genConfigInput GenerationConfigInput, toolsInput ToolsInput) bool {
+	return genConfigInput.ThinkingBudget >= 0 || genConfigInput.IncludeThoughts ||
+		toolsInput.EnableGoogleSearch || toolsInput.EnableURLContext || toolsInput.EnableGoogleSearchRetrieval
+}
+
+// preflightModel checks that the model exists, supports generateContent and
+// supports the features requested on the command line. Feature checks are
+// only applied to Gemini model names parseModelName recognizes.
+func preflightModel(apiKey, modelName string, genConfigInput GenerationConfigInput, toolsInput ToolsInput, retryInput RetryInput) error {
+	if !strings.HasPrefix(modelName, "models/") {
+		modelName = "models/" + modelName
+	}
+
+	var model ModelInfo
+	err := doWithRetry(context.Background(), retryInput, nil, func() error {
+		return makeAPIRequest(apiKey, "GET", "/"+modelName, nil, &model)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to look up model %s: %w", modelName, err)
+	}
+	supportsGenerate := false
+	for _, method := range model.SupportedGenerationMethods {
+		if method == "generateContent" {
+			supportsGenerate = true
+			break
+		}
+	}
+	if !supportsGenerate {
+		return fmt.Errorf("model %s does not support generateContent (supports: %s)", modelName, strings.Join(model.SupportedGenerationMethods, ", "))
+	}
+
+	var problems []string
+	if name := parseModelName(modelName); name.Family == "gemini" {
+		thinking := genConfigInput.ThinkingBudget >= 0 || genConfigInput.IncludeThoughts
+		if thinking && !name.versionAtLeast(2.5) {
+			problems = append(problems, "--thinking-budget/--include-thoughts require a 2.5 model")
+		}
+		if toolsInput.EnableGoogleSearch && !name.versionAtLeast(2.0) {
+			problems = append(problems, "--tool-google-search requires a 2.0+ model; use --tool-google-search-retrieval on 1.5")
+		}
+		if toolsInput.EnableURLContext && !name.versionAtLeast(2.0) {
+			problems = append(problems, "--tool-url-context requires a 2.0+ model")
+		}
+		if toolsInput.EnableGoogleSearchRetrieval && name.versionAtLeast(2.0) {
+			problems = append(problems, "--tool-google-search-retrieval is only supported on 1.5 models; use --tool-google-search")
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("model %s does not support the requested features:\n  %s\nPass --force to send the request anyway", modelName, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ModelPricing is the price in USD per one million tokens.
+type ModelPricing struct {
+	InputPerMillion  float64 `json:"input_per_million"`
+	OutputPerMillion float64 `json:"output_per_million"`
+}
+
+// Built-in list prices for the standard (<=200k prompt) tier. These go stale;
+// entries under "pricing" in config.json take precedence.
+var defaultPricing = map[string]ModelPricing{
+	"gemini-2.5-pro":        {InputPerMillion: 1.25, OutputPerMillion: 10.00},
+	"gemini-2.5-flash":      {InputPerMillion: 0.30, OutputPerMillion: 2.50},
+	"gemini-2.5-flash-lite": {InputPerMillion: 0.10, OutputPerMillion: 0.40},
+	"gemini-2.0-flash":      {InputPerMillion: 0.10, OutputPerMillion: 0.40},
+	"gemini-2.0-flash-lite": {InputPerMillion: 0.075, OutputPerMillion: 0.30},
+	"gemini-1.5-pro":        {InputPerMillion: 1.25, OutputPerMillion: 5.00},
+	"gemini-1.5-flash":      {InputPerMillion: 0.075, OutputPerMillion: 0.30},
+	"gemini-1.5-flash-8b":   {InputPerMillion: 0.0375, OutputPerMillion: 0.15},
+}
+
+// lookupPricing finds the pricing entry for a model. Overrides are checked
+// before the built-in table, and the longest matching name prefix wins so that
+// e.g. "gemini-2.5-flash-preview-05-20" resolves to "gemini-2.5-flash".
+func lookupPricing(modelName string, overrides map[string]ModelPricing) (ModelPricing, bool) {
+	name := strings.TrimPrefix(modelName, "models/")
+	for _, table := range []map[string]ModelPricing{overrides, defaultPricing} {
+		best := ""
+		for prefix := range table {
+			if strings.HasPrefix(name, prefix) && len(prefix) > len(best) {
+				best = prefix
+			}
+		}
+		if best != "" {
+			return table[best], true
+		}
+	}
+	return ModelPricing{}, false
+}
+
+func estimateCost(pricing ModelPricing, inputTokens, outputTokens int) float64 {
+	return float64(inputTokens)/1e6*pricing.InputPerMillion + float64(outputTokens)/1e6*pricing.OutputPerMillion
+}
+
+func printCostEstimate(modelName string, usage *UsageMetadata, overrides map[string]ModelPricing) {
+	if usage == nil {
+		fmt.Fprintln(os.Stderr, "Cost estimate: response has no usageMetadata")
+		return
+	}
+	pricing, ok := lookupPricing(modelName, overrides)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Cost estimate: no pricing known for %s (add it under \"pricing\" in config.json)\n", modelName)
+		return
+	}
+	// Thinking tokens are billed at the output rate.
+	outputTokens := usage.CandidatesTokenCount + usage.ThoughtsTokenCount
+	cost := estimateCost(pricing, usage.PromptTokenCount, outputTokens)
+	fmt.Fprintf(os.Stderr, "Cost estimate: %d input + %d output tokens = $%.6f USD\n", usage.PromptTokenCount, outputTokens, cost)
+}
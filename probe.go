@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// handleProbe checks, in order, that an API key is configured, that the API
+// host can be reached and that the API accepts the key, using one cheap
+// models list call. Each check is printed as it passes; the first failure
+// exits with a diagnosis and the matching --json-errors kind.
+func handleProbe(timeout time.Duration) {
+	config, err := resolveConfig()
+	if err != nil {
+		configErrorf("Error: could not load settings: %v", err)
+	}
+	if config.APIKey == "" {
+		configErrorf("Error: no API key found. Set %s or run 'set-config --key YOUR_KEY'.", envAPIKey)
+	}
+	source := "config file"
+	if os.Getenv(envAPIKey) != "" {
+		source = envAPIKey
+	} else if path, err := getConfigPath(); err == nil {
+		source = path
+	}
+	fmt.Printf("API key:   found in %s (%s)\n", source, maskAPIKey(config.APIKey))
+	fmt.Printf("Endpoint:  %s\n", baseURL())
+
+	ctx, cancel := contextWithOptionalTimeout(timeout)
+	defer cancel()
+	start := time.Now()
+	responseBody, err := doAPIRequestContext(ctx, config.APIKey, "GET", "/models?pageSize=1000", nil)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		kind, diagnosis := diagnoseProbeError(err, timeout)
+		if kind == errorKindAPI {
+			fmt.Printf("Network:   ok (%s)\n", elapsed)
+		}
+		exitWithError(kind, "Error: "+diagnosis, err)
+	}
+	fmt.Printf("Network:   ok (%s)\n", elapsed)
+
+	var response ListModelsResponse
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		fatalf("Error: the endpoint answered but not with a models list (%v); check that it is the Gemini API", err)
+	}
+	fmt.Printf("Key valid: yes (%d models available)\n", len(response.Models))
+}
+
+// diagnoseProbeError turns a failed probe request into a kind and a
+// sentence saying what is most likely wrong.
+func diagnoseProbeError(err error, timeout time.Duration) (errorKind, string) {
+	var apiErr *APIError
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	switch {
+	case errors.As(err, &apiErr):
+		switch {
+		case strings.Contains(apiErr.Body, "API_KEY_INVALID") || strings.Contains(apiErr.Body, "API key not valid"):
+			return errorKindAPI, "the API key was rejected as invalid. Check for a typo or create a new key, then run 'set-config --key YOUR_KEY'."
+		case apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden:
+			return errorKindAPI, fmt.Sprintf("the API key is not allowed to use the Gemini API (%s). The key may be restricted to other APIs or the API may be disabled for its project.", apiErr.Status)
+		case apiErr.StatusCode == http.StatusNotFound:
+			return errorKindAPI, fmt.Sprintf("%s was not found. The base URL or --api-version is wrong.", baseURL()+"/models")
+		case apiErr.StatusCode == http.StatusTooManyRequests:
+			return errorKindAPI, "the key works but is rate limited or out of quota (429 Too Many Requests)."
+		}
+		return errorKindAPI, fmt.Sprintf("the API returned %s: %s", apiErr.Status, apiErr.Body)
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorKindNetwork, fmt.Sprintf("no response within %s. The network may be blocking %s, or a proxy is needed.", timeout, apiHost)
+	case errors.As(err, &dnsErr):
+		return errorKindNetwork, fmt.Sprintf("could not resolve %s. Check the network connection and DNS.", dnsErr.Name)
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthority):
+		return errorKindNetwork, "the server's TLS certificate was not trusted. Behind a TLS-intercepting proxy, pass its CA with --ca-cert."
+	case classifyError(err) == errorKindNetwork:
+		// The url.Error wrapper repeats the request URL, API key included
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return errorKindNetwork, fmt.Sprintf("could not connect to %s: %v", apiHost, err)
+	}
+	return errorKindGeneral, fmt.Sprintf("probe failed: %v", err)
+}
+
+// maskAPIKey shows just enough of a key to tell keys apart.
+func maskAPIKey(key string) string {
+	if len(key) <= 8 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const maxRetryBackoff = 30 * time.Second
+
+// networkErrorCode stands in for a status code in retryStats when a retry was
+// caused by a transport error rather than an HTTP response.
+const networkErrorCode = 0
+
+// retryStats records what happened across the retries of a run.
+type retryStats struct {
+	Attempts int
+	Triggers map[int]int // Status code -> number of retries it caused
+	Waited   time.Duration
+}
+
+func (s *retryStats) record(statusCode int, wait time.Duration) {
+	if s.Triggers == nil {
+		s.Triggers = map[int]int{}
+	}
+	s.Triggers[statusCode]++
+	s.Waited += wait
+}
+
+func (s *retryStats) summary() string {
+	retries := 0
+	codes := make([]int, 0, len(s.Triggers))
+	for code, n := range s.Triggers {
+		retries += n
+		codes = append(codes, code)
+	}
+	if retries == 0 {
+		return fmt.Sprintf("Retries: none (%d attempt(s))", s.Attempts)
+	}
+	sort.Ints(codes)
+	triggers := make([]string, len(codes))
+	for i, code := range codes {
+		label := strconv.Itoa(code)
+		if code == networkErrorCode {
+			label = "network"
+		}
+		triggers[i] = fmt.Sprintf("%s x%d", label, s.Triggers[code])
+	}
+	return fmt.Sprintf("Retries: %d attempt(s), %d retried (%s), %s waiting in backoff",
+		s.Attempts, retries, strings.Join(triggers, ", "), s.Waited.Round(time.Millisecond))
+}
+
+// registerRetryStatusFlag adds --retry-status-codes to fs, storing the parsed
+// codes in codes.
+func registerRetryStatusFlag(fs *flag.FlagSet, codes *[]int) {
+	fs.Func("retry-status-codes", "Comma-separated HTTP status codes to retry, replacing the built-in 429,500,502,503,504. Widening it can hide real errors behind retries. (default: 429,500,502,503,504)", func(value string) error {
+		parsed, err := parseStatusCodes(value)
+		if err != nil {
+			return err
+		}
+		*codes = parsed
+		return nil
+	})
+}
+
+// parseStatusCodes parses a comma-separated list of HTTP status codes.
+func parseStatusCodes(value string) ([]int, error) {
+	var codes []int
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		code, err := strconv.Atoi(field)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("'%s' is not an HTTP status code", field)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// isRetryableStatus reports whether a status code is worth retrying: one of
+// codes if given, otherwise rate limits and transient server errors.
+func isRetryableStatus(code int, codes []int) bool {
+	if codes != nil {
+		return slices.Contains(codes, code)
+	}
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isRetryableTransportError reports whether err is a transient network
+// failure, such as a reset connection or a response cut off mid-body, as
+// opposed to a cancellation or timeout we chose.
+func isRetryableTransportError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// doWithRetry calls fn until it succeeds or fails in a way that should not be
+// retried. Rate limits, 5xx errors and transient network errors are retried up
+// to MaxRetries times and 404s up to RetryNotFound times, with exponential backoff that honors
+// Retry-After. A wait between attempts ends early with ctx.Err() when ctx is
+// done. stats may be nil.
+func doWithRetry(ctx context.Context, retryInput RetryInput, stats *retryStats, fn func() error) error {
+	if stats == nil {
+		stats = &retryStats{}
+	}
+	retriesLeft := retryInput.MaxRetries
+	notFoundLeft := retryInput.RetryNotFound
+	backoff := time.Second
+	for {
+		stats.Attempts++
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		wait := backoff
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			switch {
+			case apiErr.StatusCode == http.StatusNotFound && notFoundLeft > 0:
+				notFoundLeft--
+			case isRetryableStatus(apiErr.StatusCode, retryInput.RetryStatusCodes) && retriesLeft > 0:
+				retriesLeft--
+			default:
+				return err
+			}
+			if apiErr.RetryAfter > 0 {
+				wait = apiErr.RetryAfter
+			}
+			fmt.Fprintf(os.Stderr, "%s, retrying in %s...\n", apiErr.Status, wait.Round(time.Millisecond))
+			stats.record(apiErr.StatusCode, wait)
+		} else {
+			if !isRetryableTransportError(err) || retriesLeft == 0 {
+				return err
+			}
+			retriesLeft--
+			fmt.Fprintf(os.Stderr, "%v, retrying in %s...\n", err, wait.Round(time.Millisecond))
+			stats.record(networkErrorCode, wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
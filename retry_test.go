@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serverTransport sends every request to a test server, whatever its host.
+type serverTransport struct {
+	server *httptest.Server
+}
+
+func (st serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, err := url.Parse(st.server.URL)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	return st.server.Client().Transport.RoundTrip(req)
+}
+
+// useTestServer makes API requests go to server for the rest of the test.
+func useTestServer(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	httpClientOnce.Do(func() {})
+	httpClient = &http.Client{Transport: serverTransport{server}}
+	t.Cleanup(func() {
+		httpClientOnce = sync.Once{}
+		httpClient = nil
+	})
+}
+
+func TestPostWithRetryRetriesDroppedConnection(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// Drop the connection without writing a response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("hijack: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	useTestServer(t, server)
+
+	var stats retryStats
+	body, err := postWithRetry("test-secret-key-1234", "/models/m:generateContent", []byte(`{}`), RetryInput{MaxRetries: 2}, &stats)
+	if err != nil {
+		t.Fatalf("postWithRetry: %v", err)
+	}
+	if string(body) != `{}` {
+		t.Errorf("body = %q, want {}", body)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("server saw %d requests, want 2", got)
+	}
+	if got := stats.Triggers[networkErrorCode]; got != 1 {
+		t.Errorf("network retries = %d, want 1", got)
+	}
+}
+
+func TestPostWithRetryMasksKeyInTransportErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+	useTestServer(t, server)
+
+	const apiKey = "test-secret-key-1234"
+	_, err := postWithRetry(apiKey, "/models/m:generateContent", []byte(`{}`), RetryInput{}, nil)
+	if err == nil {
+		t.Fatal("postWithRetry succeeded against a server that drops every connection")
+	}
+	if strings.Contains(err.Error(), apiKey) {
+		t.Errorf("transport error leaks the API key: %v", err)
+	}
+}
+
+func TestDoWithRetryWaitStopsAtDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := doWithRetry(ctx, RetryInput{MaxRetries: 2}, nil, func() error {
+		return &APIError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests", RetryAfter: time.Minute}
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("doWithRetry = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("doWithRetry waited %s past a 50ms deadline", elapsed)
+	}
+}
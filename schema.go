@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// orderedObject is a JSON object that remembers the order its keys appeared in.
+type orderedObject struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func parseOrderedObject(data []byte) (*orderedObject, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	obj := &orderedObject{values: map[string]json.RawMessage{}}
+	for dec.More() {
+		keyTok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := keyTok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if _, dup := obj.values[key]; !dup {
+			obj.keys = append(obj.keys, key)
+		}
+		obj.values[key] = value
+	}
+	if _, err := dec.Token(); err != nil { // closing '}'
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (o *orderedObject) set(key string, value json.RawMessage) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		keyJSON, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(keyJSON)
+		buf.WriteByte(':')
+		buf.Write(o.values[key])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// mergeSchemaPatch shallow-merges the top-level keys of patch into schema:
+// each key in patch replaces the schema's value for it, or is added after the
+// schema's own keys. Key order is otherwise kept for --strict-schema.
+func mergeSchemaPatch(schema, patch string) (string, error) {
+	base, err := parseOrderedObject([]byte(schema))
+	if err != nil {
+		return "", fmt.Errorf("response schema is not a JSON object: %w", err)
+	}
+	overlay, err := parseOrderedObject([]byte(patch))
+	if err != nil {
+		return "", fmt.Errorf("response schema patch is not a JSON object: %w", err)
+	}
+	for _, key := range overlay.keys {
+		base.set(key, overlay.values[key])
+	}
+	out, err := base.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	if !json.Valid(out) {
+		return "", fmt.Errorf("merged response schema is not valid JSON")
+	}
+	return string(out), nil
+}
+
+// inferSchemaFromExample builds a response schema from an example of the
+// desired output: types come from the values, arrays from their first
+// element, and every object property is required, in example order.
+func inferSchemaFromExample(example string) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(example))
+	dec.UseNumber()
+	schema, err := inferSchema(dec)
+	if err != nil {
+		return "", fmt.Errorf("invalid example JSON: %w", err)
+	}
+	if dec.More() {
+		return "", fmt.Errorf("invalid example JSON: more than one value")
+	}
+	out, err := schema.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// inferSchema reads one JSON value from dec and returns its schema.
+func inferSchema(dec *json.Decoder) (*orderedObject, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	schema := &orderedObject{values: map[string]json.RawMessage{}}
+	setType := func(t string) { schema.set("type", json.RawMessage(`"`+t+`"`)) }
+
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '[' {
+			setType("array")
+			items := &orderedObject{values: map[string]json.RawMessage{"type": json.RawMessage(`"string"`)}, keys: []string{"type"}}
+			for first := true; dec.More(); first = false {
+				item, err := inferSchema(dec)
+				if err != nil {
+					return nil, err
+				}
+				if first {
+					items = item
+				}
+			}
+			itemsJSON, err := items.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			schema.set("items", itemsJSON)
+		} else {
+			setType("object")
+			props := &orderedObject{values: map[string]json.RawMessage{}}
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				prop, err := inferSchema(dec)
+				if err != nil {
+					return nil, err
+				}
+				propJSON, err := prop.MarshalJSON()
+				if err != nil {
+					return nil, err
+				}
+				props.set(keyTok.(string), propJSON)
+			}
+			propsJSON, err := props.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			schema.set("properties", propsJSON)
+			if len(props.keys) > 0 {
+				required, _ := json.Marshal(props.keys)
+				schema.set("required", required)
+			}
+		}
+		if _, err := dec.Token(); err != nil { // closing ']' or '}'
+			return nil, err
+		}
+	case string:
+		setType("string")
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			setType("number")
+		} else {
+			setType("integer")
+		}
+	case bool:
+		setType("boolean")
+	case nil:
+		// null says nothing about the type; assume a nullable string
+		setType("string")
+		schema.set("nullable", json.RawMessage("true"))
+	}
+	return schema, nil
+}
+
+// schemaType returns the lower-cased "type" of a schema object, if any.
+func schemaType(obj *orderedObject) string {
+	var t string
+	if raw, ok := obj.values["type"]; ok {
+		json.Unmarshal(raw, &t)
+	}
+	return strings.ToLower(t)
+}
+
+// addPropertyOrdering sets propertyOrdering on every object schema to the
+// order its properties are declared in, unless one is already given.
+// The top-level schema must describe an object or an array of objects.
+func addPropertyOrdering(schema string) (string, error) {
+	root, err := parseOrderedObject([]byte(schema))
+	if err != nil {
+		return "", fmt.Errorf("response schema is not a JSON object: %w", err)
+	}
+	switch schemaType(root) {
+	case "object":
+	case "array":
+		items, ok := root.values["items"]
+		if !ok {
+			return "", fmt.Errorf("array response schema has no items")
+		}
+		itemsObj, err := parseOrderedObject(items)
+		if err != nil || schemaType(itemsObj) != "object" {
+			return "", fmt.Errorf("strict schema requires an array of object schemas")
+		}
+	default:
+		return "", fmt.Errorf("strict schema requires an object schema (or an array of objects), got type %q", schemaType(root))
+	}
+
+	if err := orderSchemaProperties(root); err != nil {
+		return "", err
+	}
+	out, err := root.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func orderSchemaProperties(obj *orderedObject) error {
+	if raw, ok := obj.values["properties"]; ok {
+		props, err := parseOrderedObject(raw)
+		if err != nil {
+			return fmt.Errorf("invalid properties: %w", err)
+		}
+		for _, key := range props.keys {
+			child, err := parseOrderedObject(props.values[key])
+			if err != nil {
+				return fmt.Errorf("invalid schema for property %q: %w", key, err)
+			}
+			if err := orderSchemaProperties(child); err != nil {
+				return err
+			}
+			childJSON, _ := child.MarshalJSON()
+			props.values[key] = childJSON
+		}
+		propsJSON, _ := props.MarshalJSON()
+		obj.values["properties"] = propsJSON
+
+		if _, ok := obj.values["propertyOrdering"]; !ok {
+			ordering, _ := json.Marshal(props.keys)
+			obj.set("propertyOrdering", ordering)
+		}
+	}
+	if raw, ok := obj.values["items"]; ok {
+		items, err := parseOrderedObject(raw)
+		if err != nil {
+			return fmt.Errorf("invalid items schema: %w", err)
+		}
+		if err := orderSchemaProperties(items); err != nil {
+			return err
+		}
+		itemsJSON, _ := items.MarshalJSON()
+		obj.values["items"] = itemsJSON
+	}
+	return nil
+}
+
+// parsePropertyOrder splits a --property-order list of property names,
+// separated by commas or newlines so an order file can list one per line.
+func parsePropertyOrder(value string) ([]string, error) {
+	var names []string
+	for _, name := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if slices.Contains(names, name) {
+			return nil, fmt.Errorf("'%s' is listed twice", name)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no property names given")
+	}
+	return names, nil
+}
+
+// applyPropertyOrder sets propertyOrdering on every object schema, replacing
+// any given one: the properties named in order come first, in that order,
+// followed by the rest in declared order. It returns the paths of those
+// unlisted properties (e.g. "address.zip"). A name in order that no object
+// schema has is an error.
+func applyPropertyOrder(schema string, order []string) (string, []string, error) {
+	root, err := parseOrderedObject([]byte(schema))
+	if err != nil {
+		return "", nil, fmt.Errorf("response schema is not a JSON object: %w", err)
+	}
+	found := map[string]bool{}
+	var unlisted []string
+	if err := orderPropertiesAs(root, "", order, found, &unlisted); err != nil {
+		return "", nil, err
+	}
+	for _, name := range order {
+		if !found[name] {
+			return "", nil, fmt.Errorf("--property-order lists '%s', which is not a property of any object in the response schema", name)
+		}
+	}
+	out, err := root.MarshalJSON()
+	if err != nil {
+		return "", nil, err
+	}
+	return string(out), unlisted, nil
+}
+
+func orderPropertiesAs(obj *orderedObject, path string, order []string, found map[string]bool, unlisted *[]string) error {
+	if raw, ok := obj.values["properties"]; ok {
+		props, err := parseOrderedObject(raw)
+		if err != nil {
+			return fmt.Errorf("invalid properties: %w", err)
+		}
+		var ordering []string
+		for _, name := range order {
+			if _, ok := props.values[name]; ok {
+				ordering = append(ordering, name)
+				found[name] = true
+			}
+		}
+		for _, key := range props.keys {
+			if !slices.Contains(order, key) {
+				ordering = append(ordering, key)
+				*unlisted = append(*unlisted, path+key)
+			}
+			child, err := parseOrderedObject(props.values[key])
+			if err != nil {
+				return fmt.Errorf("invalid schema for property %q: %w", key, err)
+			}
+			if err := orderPropertiesAs(child, path+key+".", order, found, unlisted); err != nil {
+				return err
+			}
+			childJSON, _ := child.MarshalJSON()
+			props.values[key] = childJSON
+		}
+		propsJSON, _ := props.MarshalJSON()
+		obj.values["properties"] = propsJSON
+		orderingJSON, _ := json.Marshal(ordering)
+		obj.set("propertyOrdering", orderingJSON)
+	}
+	if raw, ok := obj.values["items"]; ok {
+		items, err := parseOrderedObject(raw)
+		if err != nil {
+			return fmt.Errorf("invalid items schema: %w", err)
+		}
+		if err := orderPropertiesAs(items, path, order, found, unlisted); err != nil {
+			return err
+		}
+		itemsJSON, _ := items.MarshalJSON()
+		obj.values["items"] = itemsJSON
+	}
+	return nil
+}
+
+// resolveSchemaRefs inlines every local $ref ("#/$defs/address",
+// "#/definitions/item") in schema with the schema it points to, merged with
+// any keys next to the $ref, and then drops the top-level $defs and
+// definitions. Refs that don't resolve, point outside the document or refer
+// back to themselves are errors.
+func resolveSchemaRefs(schema string) (string, error) {
+	root := json.RawMessage(schema)
+	if _, err := parseOrderedObject(root); err != nil {
+		return "", fmt.Errorf("response schema is not a JSON object: %w", err)
+	}
+	resolved, err := resolveRefsIn(root, root, nil)
+	if err != nil {
+		return "", err
+	}
+	obj, err := parseOrderedObject(resolved)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range []string{"$defs", "definitions"} {
+		if _, ok := obj.values[key]; ok {
+			delete(obj.values, key)
+			obj.keys = slices.DeleteFunc(obj.keys, func(k string) bool { return k == key })
+		}
+	}
+	out, err := obj.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// resolveRefsIn returns value with the $refs in it and below it inlined.
+// inProgress holds the refs being expanded, to catch cycles.
+func resolveRefsIn(value, root json.RawMessage, inProgress []string) (json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(value)
+	if len(trimmed) == 0 {
+		return value, nil
+	}
+	switch trimmed[0] {
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		for i := range items {
+			var err error
+			if items[i], err = resolveRefsIn(items[i], root, inProgress); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(items)
+	case '{':
+	default:
+		return value, nil
+	}
+
+	obj, err := parseOrderedObject(trimmed)
+	if err != nil {
+		return nil, err
+	}
+	if rawRef, ok := obj.values["$ref"]; ok {
+		var ref string
+		if err := json.Unmarshal(rawRef, &ref); err != nil {
+			return nil, fmt.Errorf("$ref must be a string, got %s", rawRef)
+		}
+		if slices.Contains(inProgress, ref) {
+			return nil, fmt.Errorf("$ref %q refers back to itself and can't be inlined", ref)
+		}
+		target, err := lookupSchemaPointer(root, ref)
+		if err != nil {
+			return nil, err
+		}
+		target, err = resolveRefsIn(target, root, append(inProgress, ref))
+		if err != nil {
+			return nil, err
+		}
+		merged, err := parseOrderedObject(target)
+		if err != nil {
+			return nil, fmt.Errorf("$ref %q does not point to a schema object", ref)
+		}
+		for _, key := range obj.keys {
+			if key != "$ref" {
+				merged.set(key, obj.values[key])
+			}
+		}
+		obj = merged
+	}
+	for _, key := range obj.keys {
+		if key == "$defs" || key == "definitions" {
+			continue // Only inlined where referenced
+		}
+		if obj.values[key], err = resolveRefsIn(obj.values[key], root, inProgress); err != nil {
+			return nil, err
+		}
+	}
+	return obj.MarshalJSON()
+}
+
+// lookupSchemaPointer follows a local JSON pointer ref such as "#/$defs/item"
+// from root.
+func lookupSchemaPointer(root json.RawMessage, ref string) (json.RawMessage, error) {
+	pointer, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return nil, fmt.Errorf("$ref %q is not local; only refs within the schema (#/...) are supported", ref)
+	}
+	current := root
+	if pointer == "" {
+		return current, nil
+	}
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		trimmed := bytes.TrimSpace(current)
+		if len(trimmed) > 0 && trimmed[0] == '[' {
+			var items []json.RawMessage
+			index, err := strconv.Atoi(token)
+			if err != nil || json.Unmarshal(trimmed, &items) != nil || index < 0 || index >= len(items) {
+				return nil, fmt.Errorf("$ref %q does not resolve", ref)
+			}
+			current = items[index]
+			continue
+		}
+		obj, err := parseOrderedObject(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("$ref %q does not resolve", ref)
+		}
+		next, ok := obj.values[token]
+		if !ok {
+			return nil, fmt.Errorf("$ref %q does not resolve: no %q", ref, token)
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// parseEnumValues splits a comma-separated --response-enum list, trimming
+// spaces around each label.
+func parseEnumValues(value string) ([]string, error) {
+	var values []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			return nil, fmt.Errorf("empty label in '%s'", value)
+		}
+		if slices.Contains(values, field) {
+			return nil, fmt.Errorf("duplicate label '%s'", field)
+		}
+		values = append(values, field)
+	}
+	return values, nil
+}
+
+// enumSchema returns a string schema restricted to values. With
+// text/x.enum the answer is the bare label; with application/json it is a
+// JSON string.
+func enumSchema(values []string) json.RawMessage {
+	schema, _ := json.Marshal(map[string]interface{}{"type": "string", "enum": values})
+	return schema
+}
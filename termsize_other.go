@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "os"
+
+// ttyWidth is not implemented on this platform; callers fall back to a default.
+func ttyWidth(f *os.File) int {
+	return 0
+}
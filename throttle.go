@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The throttle is a token bucket shared by every gemini-cli process through a
+// state file in the config directory. A lock file created with O_EXCL guards
+// each read-modify-write of the state.
+type throttleState struct {
+	Tokens       float64   `json:"tokens"`
+	LastRefill   time.Time `json:"last_refill"`
+	BlockedUntil time.Time `json:"blocked_until,omitempty"`
+}
+
+const (
+	throttleLockStale = 10 * time.Second
+	throttleLockPoll  = 20 * time.Millisecond
+)
+
+func throttlePaths() (statePath, lockPath string, err error) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return "", "", err
+	}
+	if err := ensureConfigDir(configPath); err != nil {
+		return "", "", err
+	}
+	dir := filepath.Dir(configPath)
+	return filepath.Join(dir, "throttle.json"), filepath.Join(dir, "throttle.lock"), nil
+}
+
+func lockThrottle(lockPath string) (func(), error) {
+	deadline := time.Now().Add(2 * throttleLockStale)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create throttle lock %s: %w", lockPath, err)
+		}
+		// A crashed process can leave the lock behind
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > throttleLockStale {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for throttle lock %s", lockPath)
+		}
+		time.Sleep(throttleLockPoll)
+	}
+}
+
+// updateThrottle runs fn on the shared state while holding the lock.
+func updateThrottle(fn func(state *throttleState)) error {
+	statePath, lockPath, err := throttlePaths()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockThrottle(lockPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var state throttleState
+	if data, err := os.ReadFile(statePath); err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			state = throttleState{} // Start over from a corrupt file
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read throttle state %s: %w", statePath, err)
+	}
+
+	fn(&state)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal throttle state: %w", err)
+	}
+	if err := os.WriteFile(statePath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write throttle state %s: %w", statePath, err)
+	}
+	return nil
+}
+
+// acquireThrottle blocks until a request slot is free under targetRPM across
+// all processes sharing the config directory, or until ctx is done.
+func acquireThrottle(ctx context.Context, targetRPM float64) error {
+	for {
+		var wait time.Duration
+		err := updateThrottle(func(state *throttleState) {
+			now := time.Now()
+			if now.Before(state.BlockedUntil) {
+				wait = state.BlockedUntil.Sub(now)
+				return
+			}
+			if state.LastRefill.IsZero() {
+				state.Tokens = 1
+			} else {
+				state.Tokens += now.Sub(state.LastRefill).Minutes() * targetRPM
+				if state.Tokens > 1 {
+					state.Tokens = 1
+				}
+			}
+			state.LastRefill = now
+			if state.Tokens >= 1 {
+				state.Tokens--
+				return
+			}
+			wait = time.Duration((1 - state.Tokens) / targetRPM * float64(time.Minute))
+		})
+		if err != nil {
+			return err
+		}
+		if wait <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// throttleBackoff tells every process to hold off for d, e.g. after a 429
+// with Retry-After.
+func throttleBackoff(d time.Duration) error {
+	return updateThrottle(func(state *throttleState) {
+		until := time.Now().Add(d)
+		if until.After(state.BlockedUntil) {
+			state.BlockedUntil = until
+		}
+	})
+}
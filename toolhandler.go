@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// runToolHandler runs the handler command once per function call, in
+// parallel. Each invocation receives the functionCall as JSON on stdin and
+// must print either a functionResponse object ({"name": ..., "response": ...})
+// or a bare JSON object, which is used as the response.
+func runToolHandler(handlerCmd string, calls []FunctionCall) ([]Part, error) {
+	args := strings.Fields(handlerCmd)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty tool handler command")
+	}
+
+	parts := make([]Part, len(calls))
+	errs := make([]error, len(calls))
+	var wg sync.WaitGroup
+	for i, call := range calls {
+		wg.Add(1)
+		go func(i int, call FunctionCall) {
+			defer wg.Done()
+			resp, err := runToolHandlerOnce(args, call)
+			if err != nil {
+				errs[i] = fmt.Errorf("tool handler failed for %s: %w", call.Name, err)
+				return
+			}
+			parts[i] = Part{FunctionResponse: resp}
+		}(i, call)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+func runToolHandlerOnce(args []string, call FunctionCall) (*FunctionResponse, error) {
+	input, err := json.Marshal(call)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal function call: %w", err)
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = errorOutput
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	output := bytes.TrimSpace(stdout.Bytes())
+	var resp FunctionResponse
+	if err := json.Unmarshal(output, &resp); err == nil && resp.Name != "" && resp.Response != nil {
+		if resp.ID == "" {
+			resp.ID = call.ID
+		}
+		return &resp, nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(output, &obj); err != nil {
+		return nil, fmt.Errorf("handler output is not a JSON object: %w. Output: %s", err, string(output))
+	}
+	return &FunctionResponse{ID: call.ID, Name: call.Name, Response: json.RawMessage(output)}, nil
+}
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // New helper function
@@ -53,6 +67,16 @@ func readFileAsBase64(filePath string) (mimeType string, base64Data string, err
 		return "", "", fmt.Errorf("failed to read file '%s': %w", filePath, err)
 	}
 
+	mimeType = mimeTypeForFile(filePath, data)
+
+	base64Data = base64.StdEncoding.EncodeToString(data)
+	return mimeType, base64Data, nil
+}
+
+// mimeTypeForFile guesses a MIME type from the file extension, falling back to
+// sniffing the first bytes of the content.
+func mimeTypeForFile(filePath string, head []byte) string {
+	var mimeType string
 	ext := strings.ToLower(filepath.Ext(filePath))
 	switch ext {
 	case ".txt":
@@ -80,33 +104,107 @@ func readFileAsBase64(filePath string) (mimeType string, base64Data string, err
 	case ".mp4":
 		mimeType = "video/mp4"
 	default:
-		mimeType = http.DetectContentType(data)
+		mimeType = http.DetectContentType(head)
 		if mimeType == "application/octet-stream" { // If still generic, give a better generic default
 			mimeType = "application/octet-stream"
 		}
+		return mimeType
 	}
-
-	base64Data = base64.StdEncoding.EncodeToString(data)
-	return mimeType, base64Data, nil
+	if sniffMIME {
+		if sniffed, ok := contradictingMIMEType(mimeType, head); ok {
+			fmt.Fprintf(os.Stderr, "Warning: '%s' looks like %s, not %s as its extension says; sending it as %s (--sniff-mime)\n", filePath, sniffed, mimeType, sniffed)
+			mimeType = sniffed
+		}
+	}
+	return mimeType
 }
 
-func readURLAsBase64(fileURL string) (mimeType string, base64Data string, err error) {
-	resp, err := http.Get(fileURL)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to fetch URL '%s': %w", fileURL, err)
+// contradictingMIMEType sniffs head and reports the detected type if it
+// clearly contradicts guessed. Generic results (octet-stream, or text for a
+// text-like guess) and different names for the same type don't count.
+func contradictingMIMEType(guessed string, head []byte) (string, bool) {
+	sniffed, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	if sniffed == "audio/wave" {
+		sniffed = "audio/wav"
+	}
+	switch {
+	case sniffed == guessed, sniffed == "application/octet-stream":
+		return "", false
+	case strings.HasPrefix(sniffed, "text/") && (strings.HasPrefix(guessed, "text/") || guessed == "application/json"):
+		return "", false
 	}
-	defer resp.Body.Close()
+	return sniffed, true
+}
+
+const (
+	maxDownloadAttempts       = 5
+	maxDownloadBytes    int64 = 2 << 30 // Files API per-file limit
+)
+
+// downloadURL fetches fileURL, resuming with a Range request when the body is
+// cut off mid-transfer. Servers that ignore Range restart from the beginning.
+func downloadURL(client *http.Client, fileURL string) (data []byte, contentType string, err error) {
+	var lastErr error
+	for attempt := 1; attempt <= maxDownloadAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+
+		req, err := http.NewRequest("GET", fileURL, nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create request for URL '%s': %w", fileURL, err)
+		}
+		if len(data) > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(data)))
+		}
+
+		resp, err := client.Do(req)
+		if errors.Is(err, errFetchRefused) {
+			return nil, "", fmt.Errorf("failed to fetch URL '%s': %w", fileURL, err)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("failed to fetch URL '%s': %w", fileURL, err)
+			continue
+		}
+
+		switch {
+		case len(data) > 0 && resp.StatusCode == http.StatusPartialContent:
+			// Resuming
+		case resp.StatusCode == http.StatusOK:
+			data = data[:0]
+			contentType = resp.Header.Get("Content-Type")
+		default:
+			resp.Body.Close()
+			return nil, "", fmt.Errorf("failed to fetch URL '%s': status %s", fileURL, resp.Status)
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("failed to fetch URL '%s': status %s", fileURL, resp.Status)
+		buf := bytes.NewBuffer(data)
+		_, err = io.Copy(buf, io.LimitReader(resp.Body, maxDownloadBytes-int64(len(data))+1))
+		resp.Body.Close()
+		data = buf.Bytes()
+		if int64(len(data)) > maxDownloadBytes {
+			return nil, "", fmt.Errorf("URL '%s' is larger than the %d byte limit", fileURL, maxDownloadBytes)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("failed to read response body from URL '%s' after %d bytes: %w", fileURL, len(data), err)
+			continue
+		}
+		return data, contentType, nil
 	}
+	return nil, "", fmt.Errorf("giving up after %d attempts: %w", maxDownloadAttempts, lastErr)
+}
 
-	data, err := io.ReadAll(resp.Body)
+func readURLAsBase64(fileURL string) (mimeType string, base64Data string, err error) {
+	client, err := getFetchClient()
+	if err != nil {
+		return "", "", err
+	}
+	data, contentType, err := downloadURL(client, fileURL)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to read response body from URL '%s': %w", fileURL, err)
+		return "", "", err
 	}
 
-	mimeType = resp.Header.Get("Content-Type")
+	mimeType = contentType
 	// Try to refine if generic or missing
 	if mimeType == "" || mimeType == "application/octet-stream" || !strings.Contains(mimeType, "/") {
 		parsedURL, _ := url.Parse(fileURL)
@@ -182,3 +280,259 @@ func parseDataURI(dataURI string) (mimeType string, base64Data string, err error
 
 	return mimeType, base64Data, nil
 }
+
+// parseByteSize parses sizes such as "512", "300KB", "7MB" or "1.5GB".
+// Units are binary (1KB = 1024 bytes).
+func parseByteSize(s string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := float64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   float64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(upper, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'. Use a number of bytes or a KB/MB/GB suffix", s)
+	}
+	return int64(n * multiplier), nil
+}
+
+// formatByteSize renders n in the binary units parseByteSize accepts, e.g.
+// "512 B" or "1.5 MB".
+func formatByteSize(n int64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if n >= unit.size {
+			return fmt.Sprintf("%.1f %s", float64(n)/float64(unit.size), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// wrapText breaks each line of text at spaces so it fits in width columns,
+// and indents every resulting line. Words longer than width are kept whole.
+func wrapText(text, indent string, width int) string {
+	var sb strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		col := 0
+		sb.WriteString(indent)
+		for _, word := range strings.Fields(line) {
+			if col > 0 && col+1+len(word) > width {
+				sb.WriteString("\n" + indent)
+				col = 0
+			}
+			if col > 0 {
+				sb.WriteString(" ")
+				col++
+			}
+			sb.WriteString(word)
+			col += len(word)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// isTerminal reports whether f is attached to a character device such as a TTY.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks the user to approve a destructive action unless --yes was given.
+// Without a terminal to prompt on, it refuses rather than guessing.
+func confirm(action string) error {
+	if assumeYes {
+		return nil
+	}
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return fmt.Errorf("refusing to %s without --yes when not running on a terminal", action)
+	}
+	fmt.Printf("%s? [y/N] ", strings.ToUpper(action[:1])+action[1:])
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("aborted")
+}
+
+// trimTextData strips a UTF-8 BOM and leading/trailing whitespace from
+// base64-encoded text content.
+func trimTextData(base64Data string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(base64Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode text data: %w", err)
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	data = bytes.TrimSpace(data)
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// textEncodings lists the encodings accepted by --part-text-encoding.
+var textEncodings = []string{"utf-8", "latin1", "utf-16le", "utf-16be"}
+
+// decodeText converts raw file content in the given encoding to a UTF-8
+// string, dropping any byte order mark. Invalid UTF-8 sequences become U+FFFD.
+func decodeText(data []byte, encoding string) (string, error) {
+	switch encoding {
+	case "utf-8":
+		data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+		return strings.ToValidUTF8(string(data), "\uFFFD"), nil
+	case "latin1":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes), nil
+	case "utf-16le", "utf-16be":
+		if len(data)%2 != 0 {
+			return "", fmt.Errorf("odd number of bytes")
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			if encoding == "utf-16le" {
+				units[i] = binary.LittleEndian.Uint16(data[2*i:])
+			} else {
+				units[i] = binary.BigEndian.Uint16(data[2*i:])
+			}
+		}
+		if len(units) > 0 && units[0] == 0xfeff {
+			units = units[1:]
+		}
+		return string(utf16.Decode(units)), nil
+	}
+	return "", fmt.Errorf("unsupported text encoding '%s'", encoding)
+}
+
+// looksBinary reports whether data is unlikely to be text in the given
+// encoding: a NUL byte in a single-byte encoding, or invalid UTF-8.
+func looksBinary(data []byte, encoding string) bool {
+	if strings.HasPrefix(encoding, "utf-16") {
+		return false
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return true
+	}
+	return encoding == "utf-8" && !utf8.Valid(data)
+}
+
+// stripImageMetadata decodes and re-encodes a JPEG or PNG image, dropping EXIF
+// and other metadata chunks. JPEGs are re-compressed, so the pixels may change
+// slightly. Other MIME types are returned unchanged.
+func stripImageMetadata(mimeType, base64Data string) (string, error) {
+	if mimeType != "image/jpeg" && mimeType != "image/png" {
+		return base64Data, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(base64Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image data: %w", err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s image: %w", mimeType, err)
+	}
+
+	var buf bytes.Buffer
+	if mimeType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to re-encode %s image: %w", mimeType, err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// promptFromEditor opens $EDITOR on a temporary file and returns what the user
+// saved. An empty file aborts, like git commit.
+func promptFromEditor() (string, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "gemini-cli-prompt-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file for editor: %w", err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	args := append(strings.Fields(editor), tmpPath)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = errorOutput
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor '%s' failed: %w", editor, err)
+	}
+
+	data, err := os.ReadFile(tmpPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read edited prompt: %w", err)
+	}
+	prompt := strings.TrimSpace(string(data))
+	if prompt == "" {
+		return "", fmt.Errorf("aborting due to empty prompt")
+	}
+	return prompt, nil
+}
+
+// terminalWidth returns the width from $COLUMNS, then the size of the terminal
+// on stdout, or a conservative default.
+func terminalWidth() int {
+	if cols, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && cols > 0 {
+		return cols
+	}
+	if cols := ttyWidth(os.Stdout); cols > 0 {
+		return cols
+	}
+	return 120
+}
+
+// Levels accepted by --compact-system-instruction.
+var compactLevels = []string{"light", "full"}
+
+// compactWhitespace removes whitespace that costs tokens without changing the
+// meaning of prose. "light" trims trailing spaces, collapses runs of spaces and
+// tabs within a line (keeping indentation) and runs of blank lines into one.
+// "full" also joins lines, leaving single spaces between words.
+func compactWhitespace(s, level string) string {
+	if level == "full" {
+		return strings.Join(strings.Fields(s), " ")
+	}
+	var out []string
+	blank := false
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		if line == "" {
+			blank = len(out) > 0
+			continue
+		}
+		body := strings.TrimLeft(line, " \t")
+		indent := line[:len(line)-len(body)]
+		if blank {
+			out = append(out, "")
+			blank = false
+		}
+		out = append(out, indent+strings.Join(strings.Fields(body), " "))
+	}
+	return strings.Join(out, "\n")
+}